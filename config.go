@@ -1,9 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -13,6 +21,40 @@ import (
 // Errors relating to configuration.
 var (
 	ErrProfileNotFound = errors.New("Profile not found")
+	ErrProfileExists   = errors.New("Profile already exists")
+	ErrUnknownKey      = errors.New("Unknown profile key")
+	ErrInvalidValue    = errors.New("Invalid value for profile key")
+	ErrInvalidAPIURL   = errors.New("Invalid API URL - it must be an absolute http or https URL")
+	ErrParentNotFound  = errors.New("Extended profile not found")
+	ErrExtendsCycle    = errors.New("Profiles extend each other in a cycle")
+	ErrProfileInUse    = errors.New("Profile is extended by other profiles")
+)
+
+// Keys used to identify profile settings in the TOML config file and on the
+// commandline. Access Key settings are nested within the accessKey table.
+const (
+	KeyExtends             = "extends"
+	KeyMaxAPITries         = "maxAPITries"
+	KeyOutput              = "output"
+	KeyAPITimeoutSecs      = "apiTimeoutSecs"
+	KeyAPIURL              = "apiURL"
+	KeySecretAccessKeyEnv  = "secretAccessKeyEnv"
+	KeySecretAccessKeyFile = "secretAccessKeyFile"
+	KeyCredentialProcess   = "credentialProcess"
+	KeyRetryServerErrors   = "retryServerErrors"
+	KeyHTTPProxy           = "httpProxy"
+	KeyNoProxy             = "noProxy"
+	KeyCABundle            = "caBundle"
+	KeyClientCert          = "clientCert"
+	KeyClientKey           = "clientKey"
+	KeyMinTLSVersion       = "minTLSVersion"
+	KeyMaxRequestsPerSec   = "maxRequestsPerSecond"
+	KeyBurst               = "burst"
+	KeyAccessKey           = "accessKey"
+	KeyEmail               = "email"
+	KeyID                  = "id"
+	KeySecretAccessKey     = "secretAccessKey"
+	KeyExpiryDate          = "expiryDate"
 )
 
 // Constants representing a specific output type
@@ -20,10 +62,15 @@ const (
 	OutputWhole          = "wholeResponse"
 	OutputBodyOnly       = "bodyOnly"
 	OutputStatusCodeOnly = "statusCodeOnly"
+	OutputWithHeaders    = "withHeaders"
 )
 
 // Profile represents a named set of defaults.
 type Profile struct {
+	// Extends optionally identifies another profile from which this profile
+	// inherits any settings it doesn't define itself.
+	Extends string
+
 	// AccessKey is used to sign API calls. An Access Key can be generated using
 	// the CLI  (TODO - describe process).
 	AccessKey els.AccessKey
@@ -37,6 +84,53 @@ type Profile struct {
 
 	// APITimeoutSecs defines how long to wait for a reply before giving up.
 	APITimeoutSecs int
+
+	// APIURL is the root URL of the ELS API to which calls are made. If empty,
+	// calls are made to the live ELS.
+	APIURL string
+
+	// SecretAccessKeyEnv optionally names an environment variable which holds
+	// the secretAccessKey, so it needn't be stored in the config file.
+	SecretAccessKeyEnv string
+
+	// SecretAccessKeyFile optionally names a file, readable only by its owner,
+	// which holds the secretAccessKey.
+	SecretAccessKeyFile string
+
+	// CredentialProcess optionally defines a command which writes the Access
+	// Key to stdout as JSON (see ProcessCredentials).
+	CredentialProcess string
+
+	// RetryServerErrors determines whether API calls which fail with 502, 503
+	// or 504 are retried.
+	RetryServerErrors bool
+
+	// HTTPProxy optionally gives the URL of the proxy through which API calls
+	// are made, instead of any given by the HTTPS_PROXY environment variable.
+	HTTPProxy string
+
+	// NoProxy optionally lists, separated by commas, the hosts and domains
+	// which are called directly rather than through the proxy.
+	NoProxy string
+
+	// CABundle optionally names a file of PEM encoded certificates of CAs to
+	// trust as well as the system's - e.g. those of an intercepting proxy.
+	CABundle string
+
+	// ClientCert and ClientKey optionally name the PEM encoded files holding
+	// a certificate and key with which to authenticate TLS connections.
+	ClientCert string
+	ClientKey  string
+
+	// MinTLSVersion optionally gives the lowest TLS version which may be used
+	// - e.g. "1.2".
+	MinTLSVersion string
+
+	// MaxRequestsPerSecond optionally limits the rate at which API calls are
+	// made, allowing bursts of up to Burst calls. Burst defaults to
+	// MaxRequestsPerSecond.
+	MaxRequestsPerSecond int
+	Burst                int
 }
 
 // Sign implements els.Signer and signs the given request with the access key.
@@ -64,6 +158,275 @@ func (p *Profile) SetDefaults() {
 	}
 }
 
+// Environment variables which override the settings of the selected profile.
+// Together they can define a complete profile, so no config file is needed.
+const (
+	EnvAccessKeyID     = "ELSCLI_ACCESS_KEY_ID"
+	EnvSecretAccessKey = "ELSCLI_SECRET_ACCESS_KEY"
+	EnvEmail           = "ELSCLI_EMAIL"
+	EnvMaxAPITries     = "ELSCLI_MAX_API_TRIES"
+	EnvOutput          = "ELSCLI_OUTPUT"
+)
+
+// envKeys maps each environment variable to the profile key it overrides.
+var envKeys = []struct {
+	env string
+	key string
+}{
+	{EnvAccessKeyID, KeyAccessKey + "." + KeyID},
+	{EnvSecretAccessKey, KeyAccessKey + "." + KeySecretAccessKey},
+	{EnvEmail, KeyAccessKey + "." + KeyEmail},
+	{EnvMaxAPITries, KeyMaxAPITries},
+	{EnvOutput, KeyOutput},
+}
+
+// ApplyEnv overrides the profile's settings with any given by the environment
+// variables in envKeys. A secretAccessKey given in the environment replaces
+// any external credential source defined in the profile.
+func (p *Profile) ApplyEnv() error {
+	for _, ek := range envKeys {
+		v := os.Getenv(ek.env)
+		if v == "" {
+			continue
+		}
+		if err := p.Set(ek.key, v); err != nil {
+			return fmt.Errorf("%s: %s", err, ek.env)
+		}
+	}
+
+	if os.Getenv(EnvSecretAccessKey) != "" {
+		p.CredentialProcess = ""
+		p.SecretAccessKeyFile = ""
+		p.SecretAccessKeyEnv = ""
+	}
+
+	return nil
+}
+
+// HasAccessKey reports whether the profile defines an Access Key which can sign
+// requests. It must be called after LoadCredentials.
+func (p *Profile) HasAccessKey() bool {
+	return p.AccessKey.ID != "" && p.AccessKey.SecretAccessKey != ""
+}
+
+// ProfileKeys lists the keys of all the settings which can be changed with Set.
+var ProfileKeys = []string{
+	KeyExtends,
+	KeyMaxAPITries,
+	KeyOutput,
+	KeyAPITimeoutSecs,
+	KeyAPIURL,
+	KeySecretAccessKeyEnv,
+	KeySecretAccessKeyFile,
+	KeyCredentialProcess,
+	KeyRetryServerErrors,
+	KeyHTTPProxy,
+	KeyNoProxy,
+	KeyCABundle,
+	KeyClientCert,
+	KeyClientKey,
+	KeyMinTLSVersion,
+	KeyMaxRequestsPerSec,
+	KeyBurst,
+	KeyAccessKey + "." + KeyEmail,
+	KeyAccessKey + "." + KeyID,
+	KeyAccessKey + "." + KeySecretAccessKey,
+	KeyAccessKey + "." + KeyExpiryDate,
+}
+
+// canonicalKey returns the profile key matching key case-insensitively, as keys
+// are matched in the TOML file.
+func canonicalKey(key string) (string, error) {
+	for _, k := range ProfileKeys {
+		if strings.EqualFold(k, key) {
+			return k, nil
+		}
+	}
+	return "", ErrUnknownKey
+}
+
+// Set updates the setting identified by key to the given value, where key is
+// one of ProfileKeys (e.g. "maxAPITries" or "accessKey.id").
+func (p *Profile) Set(key string, value string) error {
+	k, err := canonicalKey(key)
+	if err != nil {
+		return err
+	}
+
+	switch k {
+	case KeyExtends:
+		p.Extends = value
+	case KeyMaxAPITries, KeyAPITimeoutSecs:
+		i, err := strconv.Atoi(value)
+		if err != nil || i <= 0 {
+			return ErrInvalidValue
+		}
+		if k == KeyMaxAPITries {
+			p.MaxAPITries = i
+		} else {
+			p.APITimeoutSecs = i
+		}
+	case KeyOutput:
+		if !ValidOutput(value) {
+			return ErrInvalidOutput
+		}
+		p.Output = value
+	case KeyAPIURL:
+		if err := ValidAPIURL(value); err != nil {
+			return err
+		}
+		p.APIURL = value
+	case KeySecretAccessKeyEnv:
+		p.SecretAccessKeyEnv = value
+	case KeySecretAccessKeyFile:
+		p.SecretAccessKeyFile = value
+	case KeyCredentialProcess:
+		p.CredentialProcess = value
+	case KeyRetryServerErrors:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return ErrInvalidValue
+		}
+		p.RetryServerErrors = b
+	case KeyHTTPProxy:
+		if err := ValidProxyURL(value); err != nil {
+			return err
+		}
+		p.HTTPProxy = value
+	case KeyNoProxy:
+		p.NoProxy = value
+	case KeyCABundle:
+		p.CABundle = value
+	case KeyClientCert:
+		p.ClientCert = value
+	case KeyClientKey:
+		p.ClientKey = value
+	case KeyMinTLSVersion:
+		if !ValidTLSVersion(value) {
+			return ErrInvalidTLSVersion
+		}
+		p.MinTLSVersion = value
+	case KeyMaxRequestsPerSec, KeyBurst:
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 0 {
+			return ErrInvalidValue
+		}
+		if k == KeyMaxRequestsPerSec {
+			p.MaxRequestsPerSecond = i
+		} else {
+			p.Burst = i
+		}
+	case KeyAccessKey + "." + KeyEmail:
+		p.AccessKey.Email = value
+	case KeyAccessKey + "." + KeyID:
+		p.AccessKey.ID = els.AccessKeyID(value)
+	case KeyAccessKey + "." + KeySecretAccessKey:
+		p.AccessKey.SecretAccessKey = els.SecretAccessKey(value)
+	case KeyAccessKey + "." + KeyExpiryDate:
+		if value == "" {
+			p.AccessKey.ExpiryDate = time.Time{}
+			break
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return ErrInvalidValue
+		}
+		p.AccessKey.ExpiryDate = t
+	}
+
+	return nil
+}
+
+// ValidOutput reports whether o identifies one of the supported outputs.
+func ValidOutput(o string) bool {
+	switch o {
+	case OutputWhole, OutputBodyOnly, OutputStatusCodeOnly, OutputWithHeaders:
+		return true
+	}
+	return false
+}
+
+// ValidAPIURL returns ErrInvalidAPIURL unless u is empty or an absolute http or
+// https URL.
+func ValidAPIURL(u string) error {
+	if u == "" {
+		return nil
+	}
+
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+		return ErrInvalidAPIURL
+	}
+	return nil
+}
+
+// tomlValues returns the settings of the profile keyed as they are in the TOML
+// config file. The secretAccessKey is replaced with mask if mask is not empty.
+func (p *Profile) tomlValues(mask string) map[string]interface{} {
+	k := map[string]interface{}{
+		KeyEmail:           p.AccessKey.Email,
+		KeyID:              string(p.AccessKey.ID),
+		KeySecretAccessKey: string(p.AccessKey.SecretAccessKey),
+	}
+	if mask != "" && p.AccessKey.SecretAccessKey != "" {
+		k[KeySecretAccessKey] = mask
+	}
+	k[KeyExpiryDate] = ""
+	if !p.AccessKey.ExpiryDate.IsZero() {
+		k[KeyExpiryDate] = p.AccessKey.ExpiryDate.UTC().Format(time.RFC3339)
+	}
+
+	// false is the default, so is written as unset:
+	var retry interface{} = ""
+	if p.RetryServerErrors {
+		retry = true
+	}
+
+	// Zero means unlimited, so is written as unset:
+	var rate, burst interface{} = "", ""
+	if p.MaxRequestsPerSecond != 0 {
+		rate = int64(p.MaxRequestsPerSecond)
+	}
+	if p.Burst != 0 {
+		burst = int64(p.Burst)
+	}
+
+	return map[string]interface{}{
+		KeyExtends:             p.Extends,
+		KeyMaxAPITries:         int64(p.MaxAPITries),
+		KeyOutput:              p.Output,
+		KeyAPITimeoutSecs:      int64(p.APITimeoutSecs),
+		KeyAPIURL:              p.APIURL,
+		KeySecretAccessKeyEnv:  p.SecretAccessKeyEnv,
+		KeySecretAccessKeyFile: p.SecretAccessKeyFile,
+		KeyCredentialProcess:   p.CredentialProcess,
+		KeyRetryServerErrors:   retry,
+		KeyHTTPProxy:           p.HTTPProxy,
+		KeyNoProxy:             p.NoProxy,
+		KeyCABundle:            p.CABundle,
+		KeyClientCert:          p.ClientCert,
+		KeyClientKey:           p.ClientKey,
+		KeyMinTLSVersion:       p.MinTLSVersion,
+		KeyMaxRequestsPerSec:   rate,
+		KeyBurst:               burst,
+		KeyAccessKey:           k,
+	}
+}
+
+// WriteTOML writes the profile to w as a TOML table named after profileID. The
+// secretAccessKey is replaced with mask if mask is not empty.
+func (p *Profile) WriteTOML(w io.Writer, profileID string, mask string) error {
+	pt := make(map[string]interface{})
+	mergeTable(pt, p.tomlValues(mask))
+
+	doc := map[string]interface{}{
+		"profiles": map[string]interface{}{
+			profileID: pt,
+		},
+	}
+	return toml.NewEncoder(w).Encode(doc)
+}
+
 // NewProfile creates a default profile containing default settings.
 func NewProfile() *Profile {
 	p := &Profile{}
@@ -77,6 +440,296 @@ type Config struct {
 	// Profiles stores all the profiles read from the TOML file, indexed by
 	// profile ID.
 	Profiles map[string]*Profile
+
+	// doc is the TOML document the config was read from. It is retained so that
+	// writing the config preserves keys which the els-cli doesn't itself use.
+	doc map[string]interface{}
+
+	// undecoded lists the keys in the TOML document which don't match any
+	// setting - e.g. "profiles.ci.maxApiTrys".
+	undecoded []string
+
+	// invalid holds the reason each profile which couldn't be read from the TOML
+	// document was given default settings instead, indexed by profile ID.
+	invalid map[string]error
+
+	// encryption identifies how the config is encrypted when written by Write,
+	// using a key derived from passphrase.
+	encryption string
+	passphrase string
+}
+
+// ProfileIDs returns the IDs of all the profiles in the config, sorted.
+func (c *Config) ProfileIDs() []string {
+	ids := make([]string, 0, len(c.Profiles))
+	for id := range c.Profiles {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// profileTables returns the table of profiles in the retained TOML document,
+// creating it if necessary.
+func (c *Config) profileTables() map[string]interface{} {
+	if c.doc == nil {
+		c.doc = make(map[string]interface{})
+	}
+	if t, ok := c.doc["profiles"].(map[string]interface{}); ok {
+		return t
+	}
+	t := make(map[string]interface{})
+	c.doc["profiles"] = t
+	return t
+}
+
+// mergeTable copies the values in src into dst. Any existing key in dst which
+// matches a key in src case-insensitively is replaced, so that the result
+// doesn't end up with duplicate keys. An empty string in src represents a
+// setting which isn't set, so the key is removed from dst instead. Other keys in
+// dst are left untouched.
+func mergeTable(dst map[string]interface{}, src map[string]interface{}) {
+	for k, v := range src {
+		existing := deleteKey(dst, k)
+		if v == "" {
+			continue
+		}
+		if sv, ok := v.(map[string]interface{}); ok {
+			dv, ok := existing.(map[string]interface{})
+			if !ok {
+				dv = make(map[string]interface{})
+			}
+			mergeTable(dv, sv)
+			v = dv
+		}
+		dst[k] = v
+	}
+}
+
+// deleteKey removes any keys from t which match key case-insensitively. It
+// returns the value of the last key removed.
+func deleteKey(t map[string]interface{}, key string) (v interface{}) {
+	for k, tv := range t {
+		if strings.EqualFold(k, key) {
+			v = tv
+			delete(t, k)
+		}
+	}
+	return v
+}
+
+// lookupKey returns the value of the key in t which matches key
+// case-insensitively, or nil if there is none.
+func lookupKey(t map[string]interface{}, key string) interface{} {
+	for k, v := range t {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
+
+// extends returns the ID of the profile which the profile table pt extends, if
+// any.
+func extends(pt interface{}) string {
+	t, _ := pt.(map[string]interface{})
+	parent, _ := lookupKey(t, KeyExtends).(string)
+	return parent
+}
+
+// profileTable returns the table in the retained TOML document which defines
+// the profile identified by profileID, creating it if necessary.
+func (c *Config) profileTable(profileID string) map[string]interface{} {
+	t := c.profileTables()
+	if pt, ok := t[profileID].(map[string]interface{}); ok {
+		return pt
+	}
+	pt := make(map[string]interface{})
+	t[profileID] = pt
+	return pt
+}
+
+// SetProfile adds or replaces the profile identified by profileID. Keys in an
+// existing profile table which are not used by the els-cli are kept.
+func (c *Config) SetProfile(profileID string, p *Profile) {
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]*Profile)
+	}
+	c.Profiles[profileID] = p
+
+	mergeTable(c.profileTable(profileID), p.tomlValues(""))
+}
+
+// SetAccessKey replaces the Access Key of the profile identified by profileID,
+// creating the profile with default settings if it doesn't exist. Only the
+// accessKey table of an existing profile is changed, so its other settings are
+// kept.
+func (c *Config) SetAccessKey(profileID string, k els.AccessKey) {
+	p, ok := c.Profiles[profileID]
+	if !ok {
+		p = NewProfile()
+	}
+	p.AccessKey = k
+
+	if _, ok := c.profileTables()[profileID]; !ok {
+		c.SetProfile(profileID, p)
+		return
+	}
+
+	v := p.tomlValues("")
+	mergeTable(c.profileTable(profileID), map[string]interface{}{KeyAccessKey: v[KeyAccessKey]})
+}
+
+// SetValue changes the setting identified by key (one of ProfileKeys) in the
+// profile identified by profileID, creating the profile if it doesn't exist.
+// Only that setting is written to the profile's table, so settings which the
+// profile inherits remain inherited.
+func (c *Config) SetValue(profileID string, key string, value string) error {
+	k, err := canonicalKey(key)
+	if err != nil {
+		return err
+	}
+
+	p := NewProfile()
+	existing, ok := c.Profiles[profileID]
+	if ok {
+		*p = *existing
+	}
+
+	if err := p.Set(k, value); err != nil {
+		return err
+	}
+
+	if k == KeyExtends && value != "" {
+		if err := c.checkExtends(profileID, value); err != nil {
+			return err
+		}
+	}
+
+	// A profile which wasn't read from TOML has no table to change yet:
+	if _, inDoc := c.profileTables()[profileID]; ok && !inDoc {
+		c.SetProfile(profileID, p)
+		return nil
+	}
+
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]*Profile)
+	}
+	c.Profiles[profileID] = p
+
+	// Build a table containing just the changed setting:
+	v := p.tomlValues("")
+	change := map[string]interface{}{k: v[k]}
+	if path := strings.SplitN(k, ".", 2); len(path) == 2 {
+		sub := v[path[0]].(map[string]interface{})
+		change = map[string]interface{}{path[0]: map[string]interface{}{path[1]: sub[path[1]]}}
+	}
+	mergeTable(c.profileTable(profileID), change)
+
+	return nil
+}
+
+// checkExtends returns an error if profile profileID cannot extend profile
+// parent - i.e. if parent doesn't exist, or extends profileID itself.
+func (c *Config) checkExtends(profileID string, parent string) error {
+	t := c.profileTables()
+
+	for id := parent; id != ""; id = extends(t[id]) {
+		if id == profileID {
+			return fmt.Errorf("%s: %s", ErrExtendsCycle, profileID)
+		}
+		if _, ok := t[id]; !ok {
+			return fmt.Errorf("%s: %s", ErrParentNotFound, id)
+		}
+	}
+	return nil
+}
+
+// AccessKeyOwner returns the ID of the profile which defines the Access Key
+// used by profile profileID: either the profile itself, or the profile from
+// which it inherits the key.
+func (c *Config) AccessKeyOwner(profileID string) string {
+	t := c.profileTables()
+	visited := make(map[string]bool)
+
+	id := profileID
+	for !visited[id] {
+		visited[id] = true
+		pt, ok := t[id].(map[string]interface{})
+		if !ok || lookupKey(pt, KeyAccessKey) != nil || extends(pt) == "" {
+			return id
+		}
+		id = extends(pt)
+	}
+	return profileID
+}
+
+// extendedBy returns the IDs of the profiles which extend profile profileID.
+func (c *Config) extendedBy(profileID string) []string {
+	var ids []string
+	for id, pt := range c.profileTables() {
+		if extends(pt) == profileID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// RemoveProfile removes the profile identified by profileID. A profile which
+// other profiles extend cannot be removed.
+func (c *Config) RemoveProfile(profileID string) error {
+	if _, ok := c.Profiles[profileID]; !ok {
+		return ErrProfileNotFound
+	}
+	if ids := c.extendedBy(profileID); len(ids) > 0 {
+		return fmt.Errorf("%s: %s", ErrProfileInUse, strings.Join(ids, ", "))
+	}
+	delete(c.Profiles, profileID)
+	delete(c.profileTables(), profileID)
+	return nil
+}
+
+// RenameProfile changes the ID of profile from to to. It fails if to already
+// identifies a profile.
+func (c *Config) RenameProfile(from string, to string) error {
+	p, ok := c.Profiles[from]
+	if !ok {
+		return ErrProfileNotFound
+	}
+	if _, ok := c.Profiles[to]; ok {
+		return ErrProfileExists
+	}
+
+	delete(c.Profiles, from)
+	c.Profiles[to] = p
+
+	t := c.profileTables()
+	for _, id := range c.extendedBy(from) {
+		mergeTable(t[id].(map[string]interface{}), map[string]interface{}{KeyExtends: to})
+		if cp, ok := c.Profiles[id]; ok {
+			cp.Extends = to
+		}
+	}
+	if pt, ok := t[from]; ok {
+		delete(t, from)
+		t[to] = pt
+	}
+	return nil
+}
+
+// WriteTOML writes the config to w in TOML format. Profiles which were read
+// from TOML are written with any keys the els-cli doesn't recognise intact.
+func (c *Config) WriteTOML(w io.Writer) error {
+	t := c.profileTables()
+
+	for id, p := range c.Profiles {
+		if _, ok := t[id]; !ok {
+			c.SetProfile(id, p)
+		}
+	}
+
+	return toml.NewEncoder(w).Encode(c.doc)
 }
 
 // Profile returns the profile matching the given ID, or an empty profile if
@@ -89,15 +742,179 @@ func (c *Config) Profile(profileID string) (*Profile, error) {
 	return NewProfile(), ErrProfileNotFound
 }
 
+// unknownProfileError returns ErrProfileNotFound for profileID, listing the
+// profiles which do exist and suggesting the closest match, if any is close.
+func (c *Config) unknownProfileError(profileID string) error {
+	ids := c.ProfileIDs()
+	if len(ids) == 0 {
+		return fmt.Errorf("%s: '%s' - the config file defines no profiles", ErrProfileNotFound, profileID)
+	}
+
+	msg := fmt.Sprintf("%s: '%s' - available profiles: %s", ErrProfileNotFound, profileID, strings.Join(ids, ", "))
+
+	best, bestD := "", -1
+	for _, id := range ids {
+		if d := editDistance(strings.ToLower(profileID), strings.ToLower(id)); bestD < 0 || d < bestD {
+			best, bestD = id, d
+		}
+	}
+
+	// Only suggest a profile which differs by a typo or two:
+	if bestD <= len(best)/3+1 {
+		msg += fmt.Sprintf(". Did you mean '%s'?", best)
+	}
+
+	return errors.New(msg)
+}
+
+// editDistance returns the Levenshtein distance between a and b - i.e. the
+// number of single character edits needed to change one into the other.
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+
+	return prev[len(rb)]
+}
+
+// resolveProfile returns the table defining the profile profileID, including
+// the settings it inherits from the profile it extends (if any). resolving
+// holds the IDs of the profiles already being resolved, to detect cycles.
+func (c *Config) resolveProfile(profileID string, resolving map[string]bool) (map[string]interface{}, error) {
+	t := c.profileTables()
+	pt, _ := t[profileID].(map[string]interface{})
+
+	parent := extends(pt)
+	if parent == "" {
+		return pt, nil
+	}
+
+	if resolving[profileID] {
+		return nil, fmt.Errorf("%s: %s", ErrExtendsCycle, profileID)
+	}
+	resolving[profileID] = true
+
+	if _, ok := t[parent]; !ok {
+		return nil, fmt.Errorf("%s: profile '%s' extends '%s'", ErrParentNotFound, profileID, parent)
+	}
+
+	inherited, err := c.resolveProfile(parent, resolving)
+	if err != nil {
+		return nil, err
+	}
+
+	r := make(map[string]interface{})
+	mergeTable(r, inherited)
+	mergeTable(r, pt)
+	return r, nil
+}
+
+// decodeProfile decodes the settings of profile profileID, including those it
+// inherits, into p. Settings which aren't given leave p unchanged.
+func (c *Config) decodeProfile(profileID string, p *Profile) error {
+	pt, err := c.resolveProfile(profileID, make(map[string]bool))
+	if err != nil {
+		return err
+	}
+	if pt == nil {
+		return fmt.Errorf("%s: profile '%s' is not a table", ErrInvalidValue, profileID)
+	}
+
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(pt); err != nil {
+		return err
+	}
+
+	if _, err := toml.Decode(b.String(), p); err != nil {
+		return fmt.Errorf("%s: profile '%s': %s", ErrInvalidValue, profileID, err)
+	}
+	return nil
+}
+
 // ReadTOML returns a config object initialised with the TOML data provided by
-// the reader.
+// the reader. Profiles which extend another profile inherit any settings they
+// don't define themselves. If a profile can't be resolved (see decodeProfile),
+// the config is returned along with the error.
 func ReadTOML(r io.Reader) (c *Config, err error) {
 	c = &Config{}
 
-	_, err = toml.DecodeReader(r, c)
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return c, err
+	}
+
+	if _, err = toml.Decode(string(data), &c.doc); err != nil {
+		return c, err
+	}
+
+	// Note any keys which don't match a setting, so Validate can report them.
+	// Each profile is decoded separately, so that a profile with a value of the
+	// wrong type (which decodeProfile reports) doesn't stop the others being
+	// checked:
+	var raw struct {
+		Profiles map[string]toml.Primitive
+	}
+	md, err := toml.Decode(string(data), &raw)
+	if err != nil {
+		return c, err
+	}
+	wrongType := make(map[string]bool)
+	for id, pt := range raw.Profiles {
+		wrongType[id] = md.PrimitiveDecode(pt, &Profile{}) != nil
+	}
+	for _, k := range md.Undecoded() {
+		if len(k) > 1 && k[0] == "profiles" && wrongType[k[1]] {
+			continue
+		}
+		c.undecoded = append(c.undecoded, k.String())
+	}
+
+	// Resolve inheritance between the profile tables, and decode each profile. A
+	// profile which can't be resolved or decoded is noted and given default
+	// settings, so that the rest of the config can be used and the config
+	// commands can fix it. The first such problem is returned:
+	ids := make([]string, 0, len(c.profileTables()))
+	for id := range c.profileTables() {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
 
-	for _, p := range c.Profiles {
+	c.Profiles = make(map[string]*Profile)
+	for _, id := range ids {
+		p := &Profile{}
+		if pErr := c.decodeProfile(id, p); pErr != nil {
+			if c.invalid == nil {
+				c.invalid = make(map[string]error)
+			}
+			c.invalid[id] = pErr
+			if err == nil {
+				err = pErr
+			}
+			p = &Profile{}
+		}
 		p.SetDefaults()
+		c.Profiles[id] = p
 	}
 
 	return c, err
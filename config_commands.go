@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jawher/mow.cli"
+	"github.com/spf13/afero"
+)
+
+// Errors relating to managing the config file.
+var (
+	ErrNoConfigFile   = errors.New("The location of the config file could not be determined")
+	ErrConfigExists   = errors.New("The config file already exists - use --force to replace it")
+	ErrConfigNotFound = errors.New("The config file doesn't exist")
+)
+
+// secretMask replaces the secretAccessKey when a profile is shown.
+const secretMask = "********"
+
+// writeConfig replaces the config file with the current config, encrypted as
+// it was when read. The new config is written to a temporary file which is then
+// renamed, so the config file is never left partially written.
+func (e *ELSCLI) writeConfig() error {
+	if e.configFile == "" {
+		return ErrNoConfigFile
+	}
+
+	var b bytes.Buffer
+	if err := e.config.Write(&b); err != nil {
+		return err
+	}
+
+	if err := e.fs.MkdirAll(filepath.Dir(e.configFile), 0700); err != nil {
+		return err
+	}
+
+	tmp := e.configFile + ".tmp"
+	f, err := e.fs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(b.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = e.fs.Rename(tmp, e.configFile)
+	}
+	if err != nil {
+		e.fs.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// initConfig creates a new config file containing a single profile with
+// default settings. An existing config file is only replaced if force is set.
+func (e *ELSCLI) initConfig(profileID string, force bool) {
+	if e.configFile == "" {
+		e.fatalError(ErrNoConfigFile)
+		return
+	}
+
+	exists, err := afero.Exists(e.fs, e.configFile)
+	if err != nil {
+		e.fatalError(err)
+		return
+	}
+	if exists && !force {
+		e.fatalError(ErrConfigExists)
+		return
+	}
+
+	e.config = &Config{}
+	e.config.SetProfile(profileID, NewProfile())
+
+	if err := e.writeConfig(); err != nil {
+		e.fatalError(err)
+		return
+	}
+
+	fmt.Fprintf(e.outputStream, "Created %s with profile '%s'\n", e.configFile, profileID)
+}
+
+// listProfiles outputs the IDs of all the profiles in the config file.
+func (e *ELSCLI) listProfiles() {
+	for _, id := range e.config.ProfileIDs() {
+		fmt.Fprintln(e.outputStream, id)
+	}
+}
+
+// showProfile outputs the settings of a profile in TOML format. The
+// secretAccessKey is masked unless showSecret is set.
+func (e *ELSCLI) showProfile(profileID string, showSecret bool) {
+	p, ok := e.config.Profiles[profileID]
+	if !ok {
+		e.fatalError(ErrProfileNotFound)
+		return
+	}
+
+	mask := secretMask
+	if showSecret {
+		mask = ""
+	}
+
+	if err := p.WriteTOML(e.outputStream, profileID, mask); err != nil {
+		e.fatalError(err)
+	}
+}
+
+// setProfileValue changes a single setting in a profile, creating the profile
+// if it doesn't already exist.
+func (e *ELSCLI) setProfileValue(profileID string, key string, value string) {
+	if err := e.config.SetValue(profileID, key, value); err != nil {
+		e.fatalError(fmt.Errorf("%s: %s", err, key))
+		return
+	}
+
+	if err := e.writeConfig(); err != nil {
+		e.fatalError(err)
+	}
+}
+
+// removeProfile deletes a profile from the config file.
+func (e *ELSCLI) removeProfile(profileID string) {
+	if err := e.config.RemoveProfile(profileID); err != nil {
+		e.fatalError(err)
+		return
+	}
+
+	if err := e.writeConfig(); err != nil {
+		e.fatalError(err)
+	}
+}
+
+// renameProfile changes the ID of a profile in the config file.
+func (e *ELSCLI) renameProfile(from string, to string) {
+	if err := e.config.RenameProfile(from, to); err != nil {
+		e.fatalError(err)
+		return
+	}
+
+	if err := e.writeConfig(); err != nil {
+		e.fatalError(err)
+	}
+}
+
+// validateConfig reports every problem found in the config file. It fails if
+// any of the problems is an error rather than a warning.
+func (e *ELSCLI) validateConfig() {
+	if e.configFile == "" {
+		e.fatalError(ErrNoConfigFile)
+		return
+	}
+
+	exists, err := afero.Exists(e.fs, e.configFile)
+	if err != nil {
+		e.fatalError(err)
+		return
+	}
+	if !exists {
+		e.fatalError(fmt.Errorf("%s: %s", ErrConfigNotFound, e.configFile))
+		return
+	}
+
+	failed := false
+	for _, p := range e.config.Validate(e.tp.Now()) {
+		fmt.Fprintln(e.outputStream, p)
+		failed = failed || !p.Warning
+	}
+
+	if failed {
+		e.fatalError(ErrInvalidConfig)
+		return
+	}
+
+	fmt.Fprintf(e.outputStream, "%s is valid\n", e.configFile)
+}
+
+// newPassphrase obtains the passphrase with which to encrypt the config file,
+// either from the environment or by asking the user to enter it twice. The
+// prompts are written to the error stream, like those for passwords.
+func (e *ELSCLI) newPassphrase() (string, error) {
+	if pp := os.Getenv(EnvConfigPassphrase); pp != "" {
+		return pp, nil
+	}
+
+	fmt.Fprintln(e.errorStream, "Choose a passphrase to encrypt the config file.")
+	pp, err := e.pw.GetPassword()
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintln(e.errorStream, "Repeat the passphrase.")
+	repeated, err := e.pw.GetPassword()
+	if err != nil {
+		return "", err
+	}
+
+	if pp != repeated {
+		return "", ErrPassphraseMismatch
+	}
+
+	return pp, nil
+}
+
+// encryptConfig encrypts the config file, or just the secretAccessKeys in it,
+// with a new passphrase. An encrypted config file is re-encrypted, so this can
+// also be used to change the passphrase.
+func (e *ELSCLI) encryptConfig(secretsOnly bool) {
+	exists, err := afero.Exists(e.fs, e.configFile)
+	if err != nil {
+		e.fatalError(err)
+		return
+	}
+	if !exists {
+		e.fatalError(fmt.Errorf("%s: %s", ErrConfigNotFound, e.configFile))
+		return
+	}
+
+	enc := EncryptFile
+	if secretsOnly {
+		enc = EncryptSecrets
+	}
+
+	pp, err := e.newPassphrase()
+	if err != nil {
+		e.fatalError(err)
+		return
+	}
+
+	if err := e.config.Encrypt(enc, pp); err != nil {
+		e.fatalError(err)
+		return
+	}
+
+	if err := e.writeConfig(); err != nil {
+		e.fatalError(err)
+		return
+	}
+
+	fmt.Fprintf(e.outputStream, "Encrypted %s\n", e.configFile)
+}
+
+// decryptConfig removes the encryption from the config file.
+func (e *ELSCLI) decryptConfig() {
+	if err := e.config.Decrypt(); err != nil {
+		e.fatalError(err)
+		return
+	}
+
+	if err := e.writeConfig(); err != nil {
+		e.fatalError(err)
+		return
+	}
+
+	fmt.Fprintf(e.outputStream, "Decrypted %s\n", e.configFile)
+}
+
+// configCommands defines the commands which manage the profiles in the config
+// file.
+func configCommands(cfgC *cli.Cmd) {
+
+	cfgC.Command("init", "Create a config file containing a profile with default settings", func(c *cli.Cmd) {
+		c.Spec = "[--force] [PROFILE]"
+		force := c.BoolOpt("force", false, "Replace the config file if it already exists")
+		profileID := c.StringArg("PROFILE", "default", "The ID of the profile to create")
+		c.Action = func() {
+			gApp.initConfig(*profileID, *force)
+		}
+	})
+
+	cfgC.Command("list", "List the IDs of all the profiles", func(c *cli.Cmd) {
+		c.Action = func() {
+			gApp.listProfiles()
+		}
+	})
+
+	cfgC.Command("show", "Show the settings of a profile (by default, the profile given by --profile)", func(c *cli.Cmd) {
+		c.Spec = "[--show-secret] [PROFILE]"
+		showSecret := c.BoolOpt("show-secret", false, "Show the secretAccessKey instead of masking it")
+		profileID := c.StringArg("PROFILE", "", "The ID of the profile to show")
+		c.Action = func() {
+			if *profileID == "" {
+				*profileID = gApp.profileID
+			}
+			gApp.showProfile(*profileID, *showSecret)
+		}
+	})
+
+	cfgC.Command("set", "Change a setting in a profile, creating the profile if necessary", func(c *cli.Cmd) {
+		c.Spec = "PROFILE KEY VALUE"
+		profileID := c.StringArg("PROFILE", "", "The ID of the profile to change")
+		key := c.StringArg("KEY", "", "The setting to change: "+strings.Join(ProfileKeys, "|"))
+		value := c.StringArg("VALUE", "", "The new value of the setting")
+		c.Action = func() {
+			gApp.setProfileValue(*profileID, *key, *value)
+		}
+	})
+
+	cfgC.Command("remove", "Remove a profile", func(c *cli.Cmd) {
+		profileID := c.StringArg("PROFILE", "", "The ID of the profile to remove")
+		c.Action = func() {
+			gApp.removeProfile(*profileID)
+		}
+	})
+
+	cfgC.Command("validate", "Check the config file for errors, such as unknown keys, invalid values and expired Access Keys", func(c *cli.Cmd) {
+		c.Action = func() {
+			gApp.validateConfig()
+		}
+	})
+
+	cfgC.Command("encrypt", "Encrypt the config file with a passphrase (given by "+EnvConfigPassphrase+" or prompted for)", func(c *cli.Cmd) {
+		c.Spec = "[--secrets-only]"
+		secretsOnly := c.BoolOpt("secrets-only", false, "Only encrypt the secretAccessKeys, leaving the rest of the config file readable")
+		c.Action = func() {
+			gApp.encryptConfig(*secretsOnly)
+		}
+	})
+
+	cfgC.Command("decrypt", "Remove the encryption from the config file", func(c *cli.Cmd) {
+		c.Action = func() {
+			gApp.decryptConfig()
+		}
+	})
+
+	cfgC.Command("rename", "Change the ID of a profile", func(c *cli.Cmd) {
+		from := c.StringArg("FROM", "", "The current ID of the profile")
+		to := c.StringArg("TO", "", "The new ID of the profile")
+		c.Action = func() {
+			gApp.renameProfile(*from, *to)
+		}
+	})
+}
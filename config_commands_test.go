@@ -0,0 +1,326 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	em "github.com/elasticlic/els-api-sdk-go/els/mock"
+	cli "github.com/elasticlic/els-cli"
+	"github.com/elasticlic/go-utils/datetime"
+	jcli "github.com/jawher/mow.cli"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/afero"
+)
+
+// alternatingPassworder returns a different password each time it is asked.
+type alternatingPassworder struct {
+	n int
+}
+
+// GetPassword implements interface main.Passworder.
+func (p *alternatingPassworder) GetPassword() (string, error) {
+	p.n++
+	return fmt.Sprintf("password%d", p.n), nil
+}
+
+var _ = Describe("Config Commands Test Suite", func() {
+
+	var (
+		sut      *cli.ELSCLI
+		config   *cli.Config
+		fs       afero.Fs
+		args     []string
+		outS     bytes.Buffer
+		errS     bytes.Buffer
+		fatalErr error
+		pw       cli.Passworder
+		ac       *em.APICaller
+		cFile    = "/home/user/.els/els-cli.toml"
+
+		// readConfig reads back the config file written by the command.
+		readConfig = func() *cli.Config {
+			f, err := fs.Open(cFile)
+			Expect(err).To(BeNil())
+			defer f.Close()
+			c, err := cli.ReadTOML(f)
+			Expect(err).To(BeNil())
+			return c
+		}
+	)
+
+	BeforeEach(func() {
+		args = []string{"els-cli", "config"}
+		fs = afero.NewMemMapFs()
+		outS = bytes.Buffer{}
+		errS = bytes.Buffer{}
+		pw = cli.NewStringPassworder("", nil)
+		ac = em.NewAPICaller()
+
+		afero.WriteFile(fs, cFile, []byte(`
+			[profiles.default]
+				maxAPITries = 3
+				[profiles.default.accessKey]
+					id = "elsID1"
+					secretAccessKey = "secretAccessKey1"
+					email = "email1@example.com"
+			[profiles.ci]
+				output = "bodyOnly"
+		`), 0600)
+		config = readConfig()
+	})
+
+	JustBeforeEach(func() {
+		sut = cli.NewELSCLI(jcli.App("els-cli", ""), config, cFile, datetime.NewNowTimeProvider(), fs, ac, &MockPipe{}, pw, &outS, &errS)
+		fatalErr = sut.Run(args)
+	})
+
+	Describe("init", func() {
+		BeforeEach(func() {
+			args = append(args, "init", "new")
+		})
+		Context("The config file exists", func() {
+			It("refuses to replace it", func() {
+				Expect(fatalErr).To(Equal(cli.ErrConfigExists))
+				Expect(readConfig().ProfileIDs()).To(Equal([]string{"ci", "default"}))
+			})
+		})
+		Context("The config file doesn't exist", func() {
+			BeforeEach(func() {
+				fs = afero.NewMemMapFs()
+				config = &cli.Config{}
+			})
+			It("creates it with a default profile", func() {
+				Expect(fatalErr).To(BeNil())
+				c := readConfig()
+				Expect(c.ProfileIDs()).To(Equal([]string{"new"}))
+				Expect(c.Profiles["new"]).To(Equal(cli.NewProfile()))
+			})
+		})
+	})
+
+	Describe("list", func() {
+		BeforeEach(func() {
+			args = append(args, "list")
+		})
+		It("lists the profile IDs", func() {
+			Expect(fatalErr).To(BeNil())
+			Expect(outS.String()).To(Equal("ci\ndefault\n"))
+		})
+	})
+
+	Describe("show", func() {
+		BeforeEach(func() {
+			args = append(args, "show")
+		})
+		It("shows the selected profile with the secret masked", func() {
+			Expect(fatalErr).To(BeNil())
+			Expect(outS.String()).To(ContainSubstring("[profiles.default]"))
+			Expect(outS.String()).To(ContainSubstring("elsID1"))
+			Expect(outS.String()).NotTo(ContainSubstring("secretAccessKey1"))
+		})
+		Context("--show-secret is given", func() {
+			BeforeEach(func() {
+				args = append(args, "--show-secret", "default")
+			})
+			It("shows the secret", func() {
+				Expect(outS.String()).To(ContainSubstring("secretAccessKey1"))
+			})
+		})
+		Context("An unknown profile is given", func() {
+			BeforeEach(func() {
+				args = append(args, "unknown")
+			})
+			It("returns ErrProfileNotFound", func() {
+				Expect(fatalErr).To(Equal(cli.ErrProfileNotFound))
+			})
+		})
+	})
+
+	Describe("set", func() {
+		Context("The profile exists", func() {
+			BeforeEach(func() {
+				args = append(args, "set", "ci", "maxAPITries", "4")
+			})
+			It("updates only that setting", func() {
+				Expect(fatalErr).To(BeNil())
+				c := readConfig()
+				Expect(c.Profiles["ci"].MaxAPITries).To(Equal(4))
+				Expect(c.Profiles["ci"].Output).To(Equal(cli.OutputBodyOnly))
+				Expect(c.Profiles["default"].AccessKey.ID).To(BeEquivalentTo("elsID1"))
+			})
+		})
+		Context("The profile doesn't exist", func() {
+			BeforeEach(func() {
+				args = append(args, "set", "new", "accessKey.id", "elsID2")
+			})
+			It("creates the profile", func() {
+				Expect(fatalErr).To(BeNil())
+				Expect(readConfig().Profiles["new"].AccessKey.ID).To(BeEquivalentTo("elsID2"))
+			})
+		})
+		Context("An invalid value is given", func() {
+			BeforeEach(func() {
+				args = append(args, "set", "ci", "output", "everything")
+			})
+			It("leaves the config file unchanged", func() {
+				Expect(fatalErr).NotTo(BeNil())
+				Expect(readConfig().Profiles["ci"].Output).To(Equal(cli.OutputBodyOnly))
+			})
+		})
+	})
+
+	Describe("remove", func() {
+		BeforeEach(func() {
+			args = append(args, "remove", "ci")
+		})
+		It("removes the profile", func() {
+			Expect(fatalErr).To(BeNil())
+			Expect(readConfig().ProfileIDs()).To(Equal([]string{"default"}))
+		})
+	})
+
+	Describe("validate", func() {
+		BeforeEach(func() {
+			args = append(args, "validate")
+		})
+		Context("The config has errors", func() {
+			It("reports them and fails", func() {
+				Expect(fatalErr).To(Equal(cli.ErrInvalidConfig))
+				Expect(outS.String()).To(ContainSubstring("error: profiles.ci.accessKey.id: " + cli.ErrMissingValue.Error()))
+			})
+		})
+		Context("The config has no errors", func() {
+			BeforeEach(func() {
+				delete(config.Profiles, "ci")
+			})
+			It("succeeds", func() {
+				Expect(fatalErr).To(BeNil())
+				Expect(outS.String()).To(HaveSuffix(cFile + " is valid\n"))
+			})
+		})
+	})
+
+	Describe("A profile can't be resolved", func() {
+		BeforeEach(func() {
+			afero.WriteFile(fs, cFile, []byte(`
+				[profiles.default]
+					[profiles.default.accessKey]
+						id = "elsID1"
+						secretAccessKey = "secretAccessKey1"
+						email = "email1@example.com"
+				[profiles.ci]
+					extends = "ci"
+			`), 0600)
+			f, err := fs.Open(cFile)
+			Expect(err).To(BeNil())
+			defer f.Close()
+			config, err = cli.ReadTOML(f)
+			Expect(err.Error()).To(HavePrefix(cli.ErrExtendsCycle.Error()))
+		})
+		Context("The config is validated", func() {
+			BeforeEach(func() {
+				args = append(args, "validate")
+			})
+			It("reports the profile", func() {
+				Expect(fatalErr).To(Equal(cli.ErrInvalidConfig))
+				Expect(outS.String()).To(ContainSubstring("error: profiles.ci: " + cli.ErrExtendsCycle.Error()))
+			})
+		})
+		Context("The profile is fixed", func() {
+			BeforeEach(func() {
+				args = append(args, "set", "ci", "extends", "default")
+			})
+			It("writes the config", func() {
+				Expect(fatalErr).To(BeNil())
+				Expect(string(readConfig().Profiles["ci"].AccessKey.ID)).To(Equal("elsID1"))
+			})
+		})
+		Context("The profile is used to call the API", func() {
+			BeforeEach(func() {
+				args = []string{"els-cli", "-p", "ci", "do", "GET", "vendors"}
+			})
+			It("refuses to make the call", func() {
+				Expect(fatalErr.Error()).To(HavePrefix(cli.ErrInvalidConfig.Error()))
+				Expect(sut.ExitCode()).To(Equal(cli.ExitUsage))
+			})
+		})
+		Context("Another profile is used to call the API", func() {
+			BeforeEach(func() {
+				args = []string{"els-cli", "do", "GET", "vendors"}
+				ac.AddExpectedCall("Do", em.APICall{ACRep: em.ACRep{Rep: em.HTTPResponse(200, "{}")}})
+			})
+			It("makes the call", func() {
+				Expect(fatalErr).To(BeNil())
+				Expect(ac.GetCall(0).ACArgs.Req.URL.Path).To(Equal("/vendors"))
+			})
+		})
+	})
+
+	Describe("encrypt", func() {
+		BeforeEach(func() {
+			os.Setenv(cli.EnvConfigPassphrase, "aPassphrase")
+			args = append(args, "encrypt")
+		})
+		AfterEach(func() {
+			os.Unsetenv(cli.EnvConfigPassphrase)
+		})
+		It("encrypts the config file", func() {
+			Expect(fatalErr).To(BeNil())
+			data, err := afero.ReadFile(fs, cFile)
+			Expect(err).To(BeNil())
+			Expect(string(data)).NotTo(ContainSubstring("secretAccessKey1"))
+
+			c, err := cli.ReadConfig(data, func() (string, error) { return "aPassphrase", nil })
+			Expect(err).To(BeNil())
+			Expect(c.Profiles).To(Equal(config.Profiles))
+		})
+		Context("The passphrase is entered twice differently", func() {
+			BeforeEach(func() {
+				os.Unsetenv(cli.EnvConfigPassphrase)
+				pw = &alternatingPassworder{}
+			})
+			It("leaves the config file unchanged", func() {
+				Expect(fatalErr).To(Equal(cli.ErrPassphraseMismatch))
+				Expect(readConfig().Profiles).To(Equal(config.Profiles))
+			})
+			It("prompts for the passphrase on stderr", func() {
+				Expect(errS.String()).To(HavePrefix("Choose a passphrase to encrypt the config file.\nRepeat the passphrase.\n"))
+				Expect(outS.String()).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("decrypt", func() {
+		BeforeEach(func() {
+			args = append(args, "decrypt")
+		})
+		Context("The config file isn't encrypted", func() {
+			It("returns ErrNotEncrypted", func() {
+				Expect(fatalErr).To(Equal(cli.ErrNotEncrypted))
+			})
+		})
+		Context("The config file is encrypted", func() {
+			BeforeEach(func() {
+				config.Encrypt(cli.EncryptSecrets, "aPassphrase")
+			})
+			It("writes the config file in plain text", func() {
+				Expect(fatalErr).To(BeNil())
+				Expect(readConfig().Profiles["default"].AccessKey.SecretAccessKey).To(BeEquivalentTo("secretAccessKey1"))
+			})
+		})
+	})
+
+	Describe("rename", func() {
+		BeforeEach(func() {
+			args = append(args, "rename", "ci", "build")
+		})
+		It("renames the profile", func() {
+			Expect(fatalErr).To(BeNil())
+			c := readConfig()
+			Expect(c.ProfileIDs()).To(Equal([]string{"build", "default"}))
+			Expect(c.Profiles["build"].Output).To(Equal(cli.OutputBodyOnly))
+		})
+	})
+})
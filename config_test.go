@@ -1,11 +1,13 @@
 package main_test
 
 import (
+	"bytes"
 	"io"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/elasticlic/els-api-sdk-go/els"
 	cli "github.com/elasticlic/els-cli"
 	. "github.com/onsi/ginkgo"
@@ -37,6 +39,47 @@ var _ = Describe("Config Test Suite", func() {
 				}))
 			})
 		})
+		Describe("Set", func() {
+			It("updates the setting identified by the key", func() {
+				Expect(sut.Set("maxAPITries", "5")).To(Succeed())
+				Expect(sut.Set("OUTPUT", cli.OutputBodyOnly)).To(Succeed())
+				Expect(sut.Set("apiTimeoutSecs", "10")).To(Succeed())
+				Expect(sut.Set("accessKey.email", "email@example.com")).To(Succeed())
+				Expect(sut.Set("accessKey.id", "anID")).To(Succeed())
+				Expect(sut.Set("accessKey.secretAccessKey", "aSAC")).To(Succeed())
+				Expect(sut.Set("accessKey.expiryDate", "2017-01-28T10:48:18Z")).To(Succeed())
+				Expect(sut.Set("apiURL", "https://staging.example.com/1.0")).To(Succeed())
+				Expect(sut.Set("retryServerErrors", "true")).To(Succeed())
+				Expect(sut.Set("maxRequestsPerSecond", "5")).To(Succeed())
+				Expect(sut.Set("burst", "10")).To(Succeed())
+				Expect(*sut).To(BeEquivalentTo(cli.Profile{
+					AccessKey: els.AccessKey{
+						ID:              "anID",
+						SecretAccessKey: "aSAC",
+						Email:           "email@example.com",
+						ExpiryDate:      time.Date(2017, 1, 28, 10, 48, 18, 0, time.UTC),
+					},
+					MaxAPITries:          5,
+					Output:               cli.OutputBodyOnly,
+					APITimeoutSecs:       10,
+					APIURL:               "https://staging.example.com/1.0",
+					RetryServerErrors:    true,
+					MaxRequestsPerSecond: 5,
+					Burst:                10,
+				}))
+			})
+			It("rejects unknown keys", func() {
+				Expect(sut.Set("maxApiTry", "5")).To(Equal(cli.ErrUnknownKey))
+			})
+			It("rejects invalid values", func() {
+				Expect(sut.Set("maxAPITries", "0")).To(Equal(cli.ErrInvalidValue))
+				Expect(sut.Set("accessKey.expiryDate", "tomorrow")).To(Equal(cli.ErrInvalidValue))
+				Expect(sut.Set("output", "everything")).To(Equal(cli.ErrInvalidOutput))
+				Expect(sut.Set("apiURL", "staging.example.com")).To(Equal(cli.ErrInvalidAPIURL))
+				Expect(sut.Set("retryServerErrors", "sometimes")).To(Equal(cli.ErrInvalidValue))
+				Expect(sut.Set("maxRequestsPerSecond", "-1")).To(Equal(cli.ErrInvalidValue))
+			})
+		})
 		Describe("Sign", func() {
 			BeforeEach(func() {
 				req, err = http.NewRequest("POST", "/1.0/url", nil)
@@ -102,6 +145,182 @@ var _ = Describe("Config Test Suite", func() {
 			})
 		})
 
+		Describe("RemoveProfile", func() {
+			It("removes an existing profile", func() {
+				Expect(sut.RemoveProfile(profileID)).To(Succeed())
+				Expect(sut.ProfileIDs()).To(BeEmpty())
+			})
+			It("returns ErrProfileNotFound for an unknown profile", func() {
+				Expect(sut.RemoveProfile("noSuchProfile")).To(Equal(cli.ErrProfileNotFound))
+			})
+		})
+
+		Describe("RenameProfile", func() {
+			It("changes the ID of the profile", func() {
+				Expect(sut.RenameProfile(profileID, "renamed")).To(Succeed())
+				Expect(sut.ProfileIDs()).To(Equal([]string{"renamed"}))
+			})
+			It("refuses to replace an existing profile", func() {
+				sut.SetProfile("another", cli.NewProfile())
+				Expect(sut.RenameProfile(profileID, "another")).To(Equal(cli.ErrProfileExists))
+			})
+		})
+
+		Describe("WriteTOML", func() {
+			var (
+				buf bytes.Buffer
+				c   *cli.Config
+			)
+			BeforeEach(func() {
+				buf.Reset()
+				c, err = cli.ReadTOML(strings.NewReader(`
+					colour = "blue"
+					[profiles.default]
+						maxAPITries = 3
+						futureSetting = true
+						[profiles.default.AccessKey]
+							id = "elsID1"
+							secretAccessKey = "secretAccessKey1"
+							email = "email1@example.com"
+							expiryDate = "2017-01-28T10:48:18Z"
+					[profiles.another]
+						apiTimeoutSecs = 20
+				`))
+				Expect(err).To(BeNil())
+			})
+			It("preserves unknown keys and untouched profiles", func() {
+				p := cli.NewProfile()
+				p.AccessKey = els.AccessKey{ID: "elsID2", SecretAccessKey: "secretAccessKey2"}
+				c.SetProfile("default", p)
+				Expect(c.WriteTOML(&buf)).To(Succeed())
+
+				var doc map[string]interface{}
+				_, err = toml.Decode(buf.String(), &doc)
+				Expect(err).To(BeNil())
+				Expect(doc["colour"]).To(Equal("blue"))
+
+				profiles := doc["profiles"].(map[string]interface{})
+				Expect(profiles["another"]).To(Equal(map[string]interface{}{"apiTimeoutSecs": int64(20)}))
+
+				d := profiles["default"].(map[string]interface{})
+				Expect(d["futureSetting"]).To(Equal(true))
+				Expect(d["maxAPITries"]).To(BeEquivalentTo(2))
+				Expect(d).NotTo(HaveKey("AccessKey"))
+				Expect(d["accessKey"]).To(Equal(map[string]interface{}{
+					"id":              "elsID2",
+					"secretAccessKey": "secretAccessKey2",
+				}))
+
+				c, err = cli.ReadTOML(&buf)
+				Expect(err).To(BeNil())
+				Expect(c.ProfileIDs()).To(Equal([]string{"another", "default"}))
+				Expect(c.Profiles["default"]).To(Equal(p))
+			})
+			It("omits removed profiles", func() {
+				Expect(c.RemoveProfile("another")).To(Succeed())
+				Expect(c.WriteTOML(&buf)).To(Succeed())
+				c, err = cli.ReadTOML(&buf)
+				Expect(err).To(BeNil())
+				Expect(c.ProfileIDs()).To(Equal([]string{"default"}))
+				Expect(c.Profiles["default"].AccessKey.ID).To(BeEquivalentTo("elsID1"))
+			})
+		})
+
+		Describe("Profile inheritance", func() {
+			var (
+				c    *cli.Config
+				buf  bytes.Buffer
+				toml = `
+					[profiles.base]
+						maxAPITries = 3
+						output = "bodyOnly"
+						[profiles.base.accessKey]
+							id = "elsID1"
+							secretAccessKey = "secretAccessKey1"
+							email = "email1@example.com"
+					[profiles.staging]
+						extends = "base"
+						apiURL = "https://staging.example.com"
+					[profiles.ci]
+						extends = "staging"
+						output = "statusCodeOnly"
+				`
+			)
+			BeforeEach(func() {
+				buf.Reset()
+				c, err = cli.ReadTOML(strings.NewReader(toml))
+				Expect(err).To(BeNil())
+			})
+			It("inherits settings a profile doesn't define", func() {
+				p, err = c.Profile("ci")
+				Expect(err).To(BeNil())
+				Expect(*p).To(BeEquivalentTo(cli.Profile{
+					Extends: "staging",
+					AccessKey: els.AccessKey{
+						ID:              "elsID1",
+						SecretAccessKey: "secretAccessKey1",
+						Email:           "email1@example.com",
+					},
+					MaxAPITries:    3,
+					Output:         cli.OutputStatusCodeOnly,
+					APITimeoutSecs: 30,
+					APIURL:         "https://staging.example.com",
+				}))
+			})
+			It("identifies the profile which defines the Access Key", func() {
+				Expect(c.AccessKeyOwner("ci")).To(Equal("base"))
+				Expect(c.AccessKeyOwner("base")).To(Equal("base"))
+			})
+			It("writes only the changed setting", func() {
+				Expect(c.SetValue("ci", "maxAPITries", "5")).To(Succeed())
+				Expect(c.WriteTOML(&buf)).To(Succeed())
+				c, err = cli.ReadTOML(&buf)
+				Expect(err).To(BeNil())
+				Expect(c.Profiles["ci"].MaxAPITries).To(Equal(5))
+				Expect(c.SetValue("base", "accessKey.id", "elsID2")).To(Succeed())
+				Expect(c.WriteTOML(&buf)).To(Succeed())
+				c, err = cli.ReadTOML(&buf)
+				Expect(err).To(BeNil())
+				Expect(c.Profiles["ci"].AccessKey.ID).To(BeEquivalentTo("elsID2"))
+			})
+			It("refuses to create a cycle", func() {
+				err = c.SetValue("base", "extends", "ci")
+				Expect(err.Error()).To(HavePrefix(cli.ErrExtendsCycle.Error()))
+			})
+			It("refuses to remove an extended profile", func() {
+				err = c.RemoveProfile("staging")
+				Expect(err.Error()).To(HavePrefix(cli.ErrProfileInUse.Error()))
+			})
+			It("updates extending profiles when a profile is renamed", func() {
+				Expect(c.RenameProfile("staging", "test")).To(Succeed())
+				Expect(c.WriteTOML(&buf)).To(Succeed())
+				c, err = cli.ReadTOML(&buf)
+				Expect(err).To(BeNil())
+				Expect(c.Profiles["ci"].Extends).To(Equal("test"))
+				Expect(c.Profiles["ci"].APIURL).To(Equal("https://staging.example.com"))
+			})
+			Context("Profiles extend each other in a cycle", func() {
+				It("returns an error", func() {
+					_, err = cli.ReadTOML(strings.NewReader(`
+						[profiles.a]
+							extends = "b"
+						[profiles.b]
+							extends = "a"
+					`))
+					Expect(err.Error()).To(HavePrefix(cli.ErrExtendsCycle.Error()))
+				})
+			})
+			Context("A profile extends a missing profile", func() {
+				It("returns an error", func() {
+					_, err = cli.ReadTOML(strings.NewReader(`
+						[profiles.a]
+							extends = "missing"
+					`))
+					Expect(err.Error()).To(HavePrefix(cli.ErrParentNotFound.Error()))
+				})
+			})
+		})
+
 		Describe("ReadTOML", func() {
 			var (
 				r    io.Reader
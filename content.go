@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ErrBinaryOutput is returned rather than writing a binary response body to a
+// terminal.
+var ErrBinaryOutput = errors.New("The response body is binary - use --out FILE to save it")
+
+// Kinds of response body, which are written differently (see writeResponse).
+const (
+	// bodyJSON is written in the requested format.
+	bodyJSON = iota
+
+	// bodyText is written as it was received.
+	bodyText
+
+	// bodyBinary is written as it was received, but never to a terminal.
+	bodyBinary
+)
+
+// bodyKind returns the kind of a response body data whose Content-Type is
+// contentType. Without a Content-Type, the kind is guessed from the data.
+func bodyKind(contentType string, data []byte) int {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mt == "" {
+		if json.Valid(data) {
+			return bodyJSON
+		}
+		mt, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+
+	switch {
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		return bodyJSON
+	case strings.HasPrefix(mt, "text/"),
+		mt == "application/xml" || strings.HasSuffix(mt, "+xml"),
+		mt == "application/javascript",
+		mt == "application/x-www-form-urlencoded":
+		return bodyText
+	}
+	return bodyBinary
+}
+
+// isTerminal reports whether w is a terminal (or another character device),
+// judged in the same way as CLIPipe judges stdin.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && (info.Mode()&os.ModeCharDevice) != 0
+}
+
+// writeOut writes a response body to the file given by --out, replacing
+// anything already in it, or otherwise to the outputStream.
+func (e *ELSCLI) writeOut(data []byte) error {
+	if e.outFile == "" {
+		_, err := e.outputStream.Write(data)
+		return err
+	}
+
+	f, err := e.fs.Create(e.outFile)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
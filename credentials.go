@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/elasticlic/els-api-sdk-go/els"
+	"github.com/spf13/afero"
+)
+
+// Errors relating to external credential sources.
+var (
+	ErrSecretEnvNotSet     = errors.New("The environment variable given by secretAccessKeyEnv is not set")
+	ErrInsecureSecretFile  = errors.New("The file given by secretAccessKeyFile must only be accessible by its owner (permissions 0600)")
+	ErrEmptySecret         = errors.New("No secretAccessKey was found in the credential source")
+	ErrCredentialProcess   = errors.New("The credentialProcess failed")
+	ErrInvalidCredentials  = errors.New("The credentialProcess output is not valid JSON")
+	ErrNoCredentialProcess = errors.New("The credentialProcess command is empty")
+	ErrUnterminatedQuote   = errors.New("The credentialProcess command has an unterminated quote")
+)
+
+// ProcessCredentials is the JSON which a credentialProcess command must write
+// to stdout. Only secretAccessKey is required - the other values replace those
+// in the profile if given.
+type ProcessCredentials struct {
+	ID              string `json:"id"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	Email           string `json:"email"`
+	ExpiryDate      string `json:"expiryDate"`
+}
+
+// LoadCredentials completes the profile's Access Key using its external
+// credential source, if it has one. Sources are used in order of precedence:
+// credentialProcess, then secretAccessKeyFile, then secretAccessKeyEnv. Any
+// secretAccessKey in the config file is only used if none is given. The
+// sources are cleared once used, so calling LoadCredentials again does nothing.
+// Output written to stderr by a credentialProcess is passed to stderr.
+func (p *Profile) LoadCredentials(fs afero.Fs, stderr io.Writer) (err error) {
+	switch {
+	case p.CredentialProcess != "":
+		err = p.runCredentialProcess(stderr)
+	case p.SecretAccessKeyFile != "":
+		err = p.readSecretFile(fs)
+	case p.SecretAccessKeyEnv != "":
+		err = p.readSecretEnv()
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	p.CredentialProcess = ""
+	p.SecretAccessKeyFile = ""
+	p.SecretAccessKeyEnv = ""
+
+	return nil
+}
+
+// readSecretEnv reads the secretAccessKey from the environment variable named
+// by SecretAccessKeyEnv.
+func (p *Profile) readSecretEnv() error {
+	s := os.Getenv(p.SecretAccessKeyEnv)
+	if s == "" {
+		return fmt.Errorf("%s: %s", ErrSecretEnvNotSet, p.SecretAccessKeyEnv)
+	}
+
+	p.AccessKey.SecretAccessKey = els.SecretAccessKey(s)
+	return nil
+}
+
+// readSecretFile reads the secretAccessKey from the file named by
+// SecretAccessKeyFile, which must not be accessible by other users.
+func (p *Profile) readSecretFile(fs afero.Fs) error {
+	info, err := fs.Stat(p.SecretAccessKeyFile)
+	if err != nil {
+		return err
+	}
+
+	// Windows doesn't support unix permissions.
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s: %s", ErrInsecureSecretFile, p.SecretAccessKeyFile)
+	}
+
+	data, err := afero.ReadFile(fs, p.SecretAccessKeyFile)
+	if err != nil {
+		return err
+	}
+
+	s := strings.TrimSpace(string(data))
+	if s == "" {
+		return ErrEmptySecret
+	}
+
+	p.AccessKey.SecretAccessKey = els.SecretAccessKey(s)
+	return nil
+}
+
+// runCredentialProcess runs the CredentialProcess command and reads the Access
+// Key from the JSON it writes to stdout. The command is split into arguments
+// by splitCommand - it is not run in a shell.
+func (p *Profile) runCredentialProcess(stderr io.Writer) error {
+	args, err := splitCommand(p.CredentialProcess)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return ErrNoCredentialProcess
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(p.APITimeoutSecs))
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &out
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", ErrCredentialProcess, err)
+	}
+
+	pc := ProcessCredentials{}
+	if err := json.Unmarshal(out.Bytes(), &pc); err != nil {
+		return ErrInvalidCredentials
+	}
+
+	if pc.SecretAccessKey == "" {
+		return ErrEmptySecret
+	}
+
+	if pc.ExpiryDate != "" {
+		t, err := time.Parse(time.RFC3339, pc.ExpiryDate)
+		if err != nil {
+			return ErrInvalidCredentials
+		}
+		p.AccessKey.ExpiryDate = t
+	}
+
+	if pc.ID != "" {
+		p.AccessKey.ID = els.AccessKeyID(pc.ID)
+	}
+
+	if pc.Email != "" {
+		p.AccessKey.Email = pc.Email
+	}
+
+	p.AccessKey.SecretAccessKey = els.SecretAccessKey(pc.SecretAccessKey)
+	return nil
+}
+
+// splitCommand splits a command into its arguments as a shell would, but
+// without expanding anything. Arguments are separated by whitespace, which
+// can be included in an argument by quoting it with single or double quotes.
+// A backslash outside single quotes escapes a following quote, backslash or
+// (outside quotes) whitespace - other backslashes are kept, so that Windows
+// paths needn't be escaped.
+func splitCommand(s string) ([]string, error) {
+	var (
+		args  []string
+		arg   []rune
+		inArg bool
+		quote rune
+	)
+
+	rs := []rune(s)
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case r == '\\' && quote != '\'' && i+1 < len(rs) && escapable(rs[i+1], quote):
+			i++
+			arg, inArg = append(arg, rs[i]), true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg = append(arg, r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, string(arg))
+				arg, inArg = arg[:0], false
+			}
+		default:
+			arg, inArg = append(arg, r), true
+		}
+	}
+
+	if quote != 0 {
+		return nil, ErrUnterminatedQuote
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+
+	return args, nil
+}
+
+// escapable reports whether a backslash escapes r, when within the given quote
+// (or 0 if none).
+func escapable(r rune, quote rune) bool {
+	if r == '"' || r == '\\' {
+		return true
+	}
+	return quote == 0 && (r == '\'' || unicode.IsSpace(r))
+}
@@ -0,0 +1,152 @@
+package main_test
+
+import (
+	"bytes"
+	"os"
+	"time"
+
+	"github.com/elasticlic/els-api-sdk-go/els"
+	cli "github.com/elasticlic/els-cli"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/afero"
+)
+
+var _ = Describe("Credentials Test Suite", func() {
+
+	var (
+		err    error
+		sut    *cli.Profile
+		fs     afero.Fs
+		errS   bytes.Buffer
+		secret = "secretFromSource"
+		envVar = "ELSCLI_TEST_SECRET"
+		file   = "/secrets/els"
+	)
+
+	BeforeEach(func() {
+		fs = afero.NewMemMapFs()
+		errS = bytes.Buffer{}
+		sut = cli.NewProfile()
+		sut.AccessKey = els.AccessKey{
+			ID:              "anID",
+			SecretAccessKey: "inlineSecret",
+			Email:           "email@example.com",
+		}
+	})
+
+	JustBeforeEach(func() {
+		err = sut.LoadCredentials(fs, &errS)
+	})
+
+	Context("No credential source is given", func() {
+		It("uses the secret from the config file", func() {
+			Expect(err).To(BeNil())
+			Expect(sut.AccessKey.SecretAccessKey).To(BeEquivalentTo("inlineSecret"))
+		})
+	})
+
+	Describe("secretAccessKeyEnv", func() {
+		BeforeEach(func() {
+			sut.SecretAccessKeyEnv = envVar
+		})
+		AfterEach(func() {
+			os.Unsetenv(envVar)
+		})
+		Context("The variable is set", func() {
+			BeforeEach(func() {
+				os.Setenv(envVar, secret)
+			})
+			It("reads the secret from the variable", func() {
+				Expect(err).To(BeNil())
+				Expect(sut.AccessKey.SecretAccessKey).To(BeEquivalentTo(secret))
+				Expect(sut.SecretAccessKeyEnv).To(BeZero())
+			})
+		})
+		Context("The variable is not set", func() {
+			It("returns an error", func() {
+				Expect(err.Error()).To(HavePrefix(cli.ErrSecretEnvNotSet.Error()))
+			})
+		})
+	})
+
+	Describe("secretAccessKeyFile", func() {
+		BeforeEach(func() {
+			sut.SecretAccessKeyFile = file
+		})
+		Context("The file is only accessible by its owner", func() {
+			BeforeEach(func() {
+				afero.WriteFile(fs, file, []byte(secret+"\n"), 0600)
+			})
+			It("reads the secret from the file", func() {
+				Expect(err).To(BeNil())
+				Expect(sut.AccessKey.SecretAccessKey).To(BeEquivalentTo(secret))
+			})
+		})
+		Context("The file is accessible by other users", func() {
+			BeforeEach(func() {
+				afero.WriteFile(fs, file, []byte(secret), 0644)
+			})
+			It("returns an error", func() {
+				Expect(err.Error()).To(HavePrefix(cli.ErrInsecureSecretFile.Error()))
+			})
+		})
+		Context("The file doesn't exist", func() {
+			It("returns an error", func() {
+				Expect(err).NotTo(BeNil())
+			})
+		})
+	})
+
+	Describe("credentialProcess", func() {
+		Context("The process writes valid credentials", func() {
+			BeforeEach(func() {
+				sut.CredentialProcess = `echo '{"id": "processID", "secretAccessKey": "` + secret + `", "expiryDate": "2030-01-28T10:48:18Z"}'`
+				// The process takes precedence over other sources:
+				sut.SecretAccessKeyEnv = envVar
+			})
+			It("reads the Access Key from the output", func() {
+				Expect(err).To(BeNil())
+				Expect(sut.AccessKey).To(Equal(els.AccessKey{
+					ID:              "processID",
+					SecretAccessKey: els.SecretAccessKey(secret),
+					Email:           "email@example.com",
+					ExpiryDate:      time.Date(2030, 1, 28, 10, 48, 18, 0, time.UTC),
+				}))
+			})
+		})
+		Context("An argument is quoted with double quotes", func() {
+			BeforeEach(func() {
+				sut.CredentialProcess = `echo "{\"secretAccessKey\": \"` + secret + `\"}"`
+			})
+			It("passes the argument with the quotes removed", func() {
+				Expect(err).To(BeNil())
+				Expect(sut.AccessKey.SecretAccessKey).To(Equal(els.SecretAccessKey(secret)))
+			})
+		})
+		Context("A quote isn't terminated", func() {
+			BeforeEach(func() {
+				sut.CredentialProcess = `echo '{"secretAccessKey": "x"}`
+			})
+			It("returns an error", func() {
+				Expect(err).To(Equal(cli.ErrUnterminatedQuote))
+			})
+		})
+		Context("The process writes invalid JSON", func() {
+			BeforeEach(func() {
+				sut.CredentialProcess = "echo not-json"
+			})
+			It("returns an error", func() {
+				Expect(err).To(Equal(cli.ErrInvalidCredentials))
+			})
+		})
+		Context("The process fails", func() {
+			BeforeEach(func() {
+				sut.CredentialProcess = "false"
+			})
+			It("returns an error", func() {
+				Expect(err.Error()).To(HavePrefix(cli.ErrCredentialProcess.Error()))
+			})
+		})
+	})
+})
@@ -50,6 +50,12 @@ the contents to put, or pipe the data into the command. E.g.:
 The descriptions below will assume specifying the contents with a filename
 argument.
 
+Exit Codes
+
+The els-cli exits with 0 if the ELS responded with 2xx, 4 for 4xx, 5 for 5xx,
+3 if the ELS API could not be reached or didn't respond in time, 2 for usage
+errors, 130 if it was interrupted (e.g. by Ctrl-C) and 1 for any other error.
+
 Vendor Commands
 
 els-cli vendor VENDORID get <filename>
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats in which --dry-run can write a request.
+const (
+	// DryRunCurl writes the request as a curl command.
+	DryRunCurl = "curl"
+
+	// DryRunHTTP writes the request as it would be sent over the wire.
+	DryRunHTTP = "http"
+
+	// DryRunJSON writes the method, URL, headers and body of the request as a
+	// JSON object.
+	DryRunJSON = "json"
+)
+
+// Errors relating to --dry-run.
+var (
+	ErrInvalidDryRunFormat = errors.New("Invalid --dry-run-format - must be: curl|http|json")
+	ErrDryRunUnsupported   = errors.New("This command can't be run with --dry-run")
+	ErrAPIRootUnknown      = errors.New("The root URL of the ELS API could not be determined - set the profile's apiURL")
+)
+
+// errDryRun is returned by doRequest instead of a response when the request
+// has been written rather than sent.
+var errDryRun = errors.New("Request not sent (--dry-run)")
+
+// ValidDryRunFormat reports whether f is a format in which --dry-run can write
+// a request.
+func ValidDryRunFormat(f string) bool {
+	return f == DryRunCurl || f == DryRunHTTP || f == DryRunJSON
+}
+
+// dryRunRequest is the JSON form of a request written by --dry-run.
+type dryRunRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// rootFinder is an els.Signer which, rather than signing a request, records
+// the URL to which it would be sent and stops it being sent.
+type rootFinder struct {
+	url *url.URL
+}
+
+// Sign implements els.Signer.
+func (f *rootFinder) Sign(r *http.Request, now time.Time) error {
+	f.url = r.URL
+	return errDryRun
+}
+
+// apiRoot returns the root URL of the ELS API to which the APICaller makes
+// calls - the profile's APIURL, or the SDK's default. It is found by asking the
+// APICaller to call the root, which is abandoned once its URL is known.
+func (e *ELSCLI) apiRoot() (string, error) {
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		return "", err
+	}
+
+	f := &rootFinder{}
+	e.apiCaller.Do(e.ctx, req, f, true)
+	if f.url == nil || !f.url.IsAbs() {
+		return "", ErrAPIRootUnknown
+	}
+
+	return strings.TrimRight(f.url.String(), "/"), nil
+}
+
+// writeDryRun signs req, whose URL is relative to the API root, and writes it
+// to the output stream in the format given by --dry-run-format, instead of
+// sending it.
+func (e *ELSCLI) writeDryRun(req *http.Request) error {
+	root, err := e.apiRoot()
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	if req.GetBody != nil {
+		b, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		body, err = ioutil.ReadAll(b)
+		b.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	signed, err := http.NewRequest(req.Method, strings.TrimRight(root, "/")+req.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for n, v := range req.Header {
+		signed.Header[n] = v
+	}
+
+	if err := e.profile.Sign(signed, e.tp.Now()); err != nil {
+		return err
+	}
+
+	switch e.dryRunFormat {
+	case DryRunHTTP:
+		return signed.Write(e.outputStream)
+	case DryRunJSON:
+		return writeDryRunJSON(e.outputStream, signed, body)
+	}
+	return writeDryRunCurl(e.outputStream, signed, body)
+}
+
+// writeDryRunCurl writes req, with the given body, to w as a curl command.
+func writeDryRunCurl(w io.Writer, req *http.Request, body []byte) error {
+	fmt.Fprintf(w, "curl -X %s %s", req.Method, shellQuote(req.URL.String()))
+
+	for _, n := range sortedHeaderNames(req.Header) {
+		for _, v := range req.Header[n] {
+			fmt.Fprintf(w, " \\\n  -H %s", shellQuote(n+": "+v))
+		}
+	}
+
+	if len(body) > 0 {
+		fmt.Fprintf(w, " \\\n  --data-binary %s", shellQuote(string(body)))
+	}
+
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// writeDryRunJSON writes req, with the given body, to w as a JSON object.
+func writeDryRunJSON(w io.Writer, req *http.Request, body []byte) error {
+	r := dryRunRequest{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Headers: make(map[string]string),
+		Body:    string(body),
+	}
+	for n := range req.Header {
+		r.Headers[n] = strings.Join(req.Header[n], ", ")
+	}
+
+	data, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// sortedHeaderNames returns the names of the headers in h, sorted.
+func sortedHeaderNames(h http.Header) []string {
+	names := make([]string, 0, len(h))
+	for n := range h {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// shellQuote quotes s so that it is passed as a single argument by a POSIX
+// shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
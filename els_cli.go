@@ -3,15 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
 	"os/user"
 	"strconv"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/elasticlic/els-api-sdk-go/els"
@@ -34,14 +37,51 @@ const Version = "0.1.0"
 const (
 	// APIRetryInterval governs the initial throttling of an API retry
 	APIRetryInterval = time.Millisecond * 500
+
+	// MaxAPIRetryInterval limits how long the throttling of an API retry can
+	// grow to, unless the ELS asks for a longer delay with Retry-After.
+	MaxAPIRetryInterval = time.Second * 30
+)
+
+// Exit codes returned by the els-cli, so that scripts can tell how a command
+// failed.
+const (
+	// ExitOK means the command succeeded - e.g. the ELS responded with 2xx.
+	ExitOK = 0
+
+	// ExitError means the command failed for a reason not covered below.
+	ExitError = 1
+
+	// ExitUsage means the commandline was invalid - e.g. an unknown profile
+	// was given.
+	ExitUsage = 2
+
+	// ExitUnreachable means the ELS API could not be reached, or didn't
+	// respond in time.
+	ExitUnreachable = 3
+
+	// ExitClientError means the ELS responded with 4xx.
+	ExitClientError = 4
+
+	// ExitServerError means the ELS responded with 5xx.
+	ExitServerError = 5
+
+	// ExitInterrupted means the els-cli was interrupted - e.g. by Ctrl-C.
+	ExitInterrupted = 130
 )
 
 // Errors presented to user.
 var (
-	ErrNoContent          = errors.New("No Content Provided - either provide a filename or pipe content to the command")
-	ErrInvalidOutput      = errors.New("Invalid output specified")
-	ErrAPIUnreachable     = errors.New("The ELS API could not be reached. Are you connected to the internet? Have you used the correct profile?")
-	ErrUnexpectedResponse = errors.New("Unexpected Response")
+	ErrNoContent             = errors.New("No Content Provided - either provide a filename or pipe content to the command")
+	ErrInvalidOutput         = errors.New("Invalid output specified")
+	ErrAPIUnreachable        = errors.New("The ELS API could not be reached. Are you connected to the internet? Have you used the correct profile?")
+	ErrUnexpectedResponse    = errors.New("Unexpected Response")
+	ErrNoAccessKey           = errors.New("The profile has no Access Key")
+	ErrKeyVerificationFailed = errors.New("The new Access Key could not sign an API call - the profile has not been changed")
+	ErrRotateExternalKey     = errors.New("The profile's Access Key is given by a credentialProcess or an environment variable, so must be rotated where it is defined")
+	ErrNoCredentials         = errors.New("No Access Key is available to sign the request - define one in the profile or set " + EnvAccessKeyID + " and " + EnvSecretAccessKey)
+	ErrAPITimeout            = errors.New("The ELS API didn't respond in time - the timeout can be changed with --timeout or the profile's apiTimeoutSecs")
+	ErrInterrupted           = errors.New("Interrupted")
 )
 
 // ELSCLI represents our App.
@@ -50,6 +90,9 @@ type ELSCLI struct {
 	// err represents a fatal error which interrupted normal execution
 	fatalErr error
 
+	// exitCode is the code with which the els-cli should exit (see ExitOK).
+	exitCode int
+
 	// fApp is a framework which parses the commandline.
 	fApp *cli.Cli
 
@@ -60,7 +103,7 @@ type ELSCLI struct {
 	configFile string
 
 	// apiCaller is used to request access keys and make signed API calls to the
-	// ELS.
+	// ELS. If nil, one is created for the API given by the selected profile.
 	apiCaller els.APICaller
 
 	// profile is the collection of properties which may be needed to make the
@@ -69,6 +112,48 @@ type ELSCLI struct {
 	// be set on with flags the commandline or via environment variables.
 	profile *Profile
 
+	// profileID identifies the profile selected via --profile.
+	profileID string
+
+	// profileErr is set if the profile selected via --profile can't be used -
+	// e.g. it doesn't exist.
+	profileErr error
+
+	// format and columns determine how response bodies are written (see
+	// writeFormatted).
+	format  string
+	columns []string
+
+	// query, if set, is applied to response bodies before they are written.
+	query *Query
+
+	// template, if set, renders response bodies in place of format.
+	template *template.Template
+
+	// outFile, if set, is the file to which response bodies are written,
+	// rather than the outputStream.
+	outFile string
+
+	// headerOnly, if set, names the only response header to be written.
+	headerOnly string
+
+	// limiter limits the rate at which API calls are made, if the profile
+	// defines a rate limit.
+	limiter *RateLimiter
+
+	// verbose is set if each API call made, and its response, should be
+	// written to the errorStream.
+	verbose bool
+
+	// dryRunFormat is set if API calls should be signed and written to the
+	// outputStream in that format (see DryRunCurl etc.) rather than sent.
+	dryRunFormat string
+
+	// recordFile and replayFile name the cassette files to which API calls are
+	// recorded, or from which they are replayed.
+	recordFile string
+	replayFile string
+
 	// fs is an abstraction of the filesystem which makes it easier to test.
 	fs afero.Fs
 
@@ -86,6 +171,10 @@ type ELSCLI struct {
 
 	// tp provides time for the app.
 	tp datetime.TimeProvider
+
+	// ctx is the parent of the context of every API call. It is cancelled if
+	// the els-cli is interrupted (e.g. by Ctrl-C).
+	ctx context.Context
 }
 
 // NewELSCLI creates a new instance of the ELS CLI App. Call Run() to execute
@@ -106,6 +195,7 @@ func NewELSCLI(
 		config:       c,
 		configFile:   cFile,
 		tp:           tp,
+		ctx:          context.Background(),
 		apiCaller:    a,
 		fs:           fs,
 		pipe:         p,
@@ -119,31 +209,178 @@ func NewELSCLI(
 // cannot be automatically captured by the cli framework.
 func (e *ELSCLI) fatalError(err error) {
 	e.fatalErr = err
+
+	switch err {
+	case ErrAPIUnreachable, ErrAPITimeout:
+		e.setExitCode(ExitUnreachable)
+	case ErrInterrupted:
+		e.setExitCode(ExitInterrupted)
+	default:
+		e.setExitCode(ExitError)
+	}
 	log.WithFields(log.Fields{"Time": e.tp.Now(), "error": err}).Debug("Fatal Error")
 	fmt.Fprintln(e.errorStream, err.Error())
 }
 
+// setExitCode records the code with which the els-cli should exit. The first
+// failure is the one reported, so a code is only recorded if none has been.
+func (e *ELSCLI) setExitCode(code int) {
+	if e.exitCode == ExitOK {
+		e.exitCode = code
+	}
+}
+
+// setStatusExitCode records the exit code which reflects the status code of a
+// response from the ELS.
+func (e *ELSCLI) setStatusExitCode(statusCode int) {
+	switch {
+	case statusCode >= 500:
+		e.setExitCode(ExitServerError)
+	case statusCode >= 400:
+		e.setExitCode(ExitClientError)
+	}
+}
+
+// ExitCode returns the code with which the els-cli should exit, once Run has
+// returned.
+func (e *ELSCLI) ExitCode() int {
+	if e.exitCode == ExitOK && e.fatalErr != nil {
+		return ExitError
+	}
+	return e.exitCode
+}
+
 // tryRequest makes a single attempt to do an API call
 func (e *ELSCLI) tryRequest(req *http.Request) (rep *http.Response, err error) {
-	if rep, err = e.apiCaller.Do(nil, req, e.profile, true); err != nil {
+	ctx, cancel := e.requestContext()
+	start := time.Now()
+
+	// With --verbose, the request is traced as soon as it is signed, so that it
+	// is shown even if no response arrives:
+	var s els.Signer = e.profile
+	ts := &tracingSigner{Signer: e.profile, e: e}
+	if e.verbose {
+		s = ts
+	}
+
+	rep, err = e.apiCaller.Do(ctx, req, s, true)
+
+	if e.verbose {
+		// An APICaller which doesn't sign requests (e.g. with --replay) hasn't
+		// traced it yet:
+		if !ts.traced {
+			e.traceRequest(req)
+		}
+		if err != nil {
+			e.traceError(err, time.Since(start))
+		} else if err = e.traceResponse(rep, time.Since(start)); err != nil {
+			rep = nil
+		}
+	}
+
+	if err != nil {
+		cancel()
 		log.WithFields(log.Fields{"Time": e.tp.Now(), "method": req.Method, "url": req.URL, "err": err}).Debug("Could not access API")
-		return nil, ErrAPIUnreachable
+
+		if err == ErrNotRecorded {
+			return nil, fmt.Errorf("%s: %s %s", err, req.Method, req.URL.RequestURI())
+		}
+		return nil, e.callError(ctx)
+	}
+
+	// The timeout also applies to reading the body, so it is only cancelled
+	// once the body is closed:
+	if rep.Body == nil {
+		cancel()
+	} else {
+		rep.Body = &cancelOnClose{ReadCloser: rep.Body, cancel: cancel}
 	}
 
 	return rep, nil
 }
 
+// callError returns the error to report for an API call, made with ctx, which
+// got no response.
+func (e *ELSCLI) callError(ctx context.Context) error {
+	switch {
+	case e.ctx.Err() != nil:
+		return ErrInterrupted
+	case ctx.Err() == context.DeadlineExceeded:
+		return ErrAPITimeout
+	}
+	return ErrAPIUnreachable
+}
+
+// requestContext returns the context for a single API call, which is cancelled
+// after the profile's timeout or if the els-cli is interrupted.
+func (e *ELSCLI) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(e.ctx, time.Second*time.Duration(e.profile.APITimeoutSecs))
+}
+
+// cancelOnClose is the body of a response which cancels the context of its
+// request when it is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer.
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
 // doRequest attempts the given request, retrying if necessary.
 func (e *ELSCLI) doRequest(req *http.Request) (rep *http.Response, err error) {
-	for t := 0; t < e.profile.MaxAPITries; t++ {
-		rep, err = e.tryRequest(req)
+	// Replayed calls aren't signed, so needn't have credentials:
+	if e.replayFile == "" {
+		if err = e.profile.LoadCredentials(e.fs, e.errorStream); err != nil {
+			return nil, err
+		}
 
-		if (err == nil) && (rep.StatusCode != http.StatusTooManyRequests) {
-			break
+		if !e.profile.HasAccessKey() {
+			return nil, ErrNoCredentials
+		}
+	}
+
+	if e.dryRunFormat != "" {
+		if err = e.writeDryRun(req); err != nil {
+			return nil, err
 		}
+		return nil, errDryRun
 	}
 
-	return
+	for t := 1; ; t++ {
+		// Each try must send the whole body again:
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		if err = e.throttle(); err != nil {
+			return nil, err
+		}
+
+		rep, err = e.tryRequest(req)
+
+		if t >= e.profile.MaxAPITries || !e.retryable(rep, err) {
+			return rep, err
+		}
+
+		d := e.retryDelay(t, rep)
+
+		if rep != nil && rep.Body != nil {
+			rep.Body.Close()
+		}
+
+		log.WithFields(log.Fields{"Time": e.tp.Now(), "method": req.Method, "url": req.URL, "try": t, "delay": d}).Debug("Retrying API call")
+
+		if err = e.wait(d); err != nil {
+			return nil, err
+		}
+	}
 }
 
 // getJSON returns a ReadCloser which will supply the JSON for the API
@@ -188,7 +425,18 @@ func (e *ELSCLI) doCall(httpMethod string, URL string, srcFile string) (rep *htt
 		}
 	}
 
-	req, err := http.NewRequest(httpMethod, URL, bodyRC)
+	// Buffer the body, so that it can be sent again if the call is retried:
+	var body io.Reader
+	if bodyRC != nil {
+		data, err := ioutil.ReadAll(bodyRC)
+		bodyRC.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(httpMethod, URL, body)
 	if err != nil {
 		log.WithFields(log.Fields{"Time": e.tp.Now(), "url": URL, "error": err}).Debug("putRequest")
 		return nil, err
@@ -208,6 +456,10 @@ func (e *ELSCLI) doCall(httpMethod string, URL string, srcFile string) (rep *htt
 func (e *ELSCLI) doCallAndRep(httpMethod string, URL string, srcFile string) (err error) {
 	rep, err := e.doCall(httpMethod, URL, srcFile)
 
+	if err == errDryRun {
+		return nil
+	}
+
 	if err != nil {
 		return err
 	}
@@ -222,9 +474,15 @@ func (e *ELSCLI) writeResponse(rep *http.Response) error {
 		defer rep.Body.Close()
 	}
 
+	e.setStatusExitCode(rep.StatusCode)
+
+	if e.headerOnly != "" {
+		return e.writeHeaderOnly(rep)
+	}
+
 	getBody := (e.profile.Output != OutputStatusCodeOnly) && (rep.Body != nil) && (rep.StatusCode != 204)
 
-	var prettyJSON bytes.Buffer
+	var body bytes.Buffer
 
 	if getBody {
 		data, err := ioutil.ReadAll(rep.Body)
@@ -232,19 +490,70 @@ func (e *ELSCLI) writeResponse(rep *http.Response) error {
 			return err
 		}
 
-		if err := json.Indent(&prettyJSON, data, "", "\t"); err != nil {
-			return err
+		switch bodyKind(rep.Header.Get("Content-Type"), data) {
+		case bodyJSON:
+			if err := e.writeBody(&body, data, e.format, e.columns); err != nil {
+				return err
+			}
+		case bodyBinary:
+			if e.outFile == "" && isTerminal(e.outputStream) {
+				return ErrBinaryOutput
+			}
+			body.Write(data)
+		default:
+			body.Write(data)
 		}
 	}
 
-	if e.profile.Output != OutputBodyOnly {
+	if e.profile.Output == OutputWithHeaders {
+		writeHeaders(e.outputStream, rep)
+	} else if e.profile.Output != OutputBodyOnly {
 		fmt.Fprintln(e.outputStream, rep.StatusCode)
 	}
 
-	if (e.profile.Output != OutputStatusCodeOnly) && (prettyJSON.Len() > 0) {
-		fmt.Fprintln(e.outputStream, prettyJSON.String())
+	if (e.profile.Output != OutputStatusCodeOnly) && (body.Len() > 0) {
+		return e.writeOut(body.Bytes())
+	}
+
+	return nil
+}
+
+// writeBody writes the JSON body data to w in format f. Any --template is used
+// in place of the format. With a --query, each of its results is written in
+// place of the body. If data isn't valid JSON it is written as it is, so it
+// isn't lost.
+func (e *ELSCLI) writeBody(w io.Writer, data []byte, f string, columns []string) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	if !json.Valid(data) {
+		_, err := w.Write(data)
+		return err
 	}
 
+	if e.query == nil {
+		if e.template != nil {
+			return writeTemplate(w, data, e.template)
+		}
+		return writeFormatted(w, data, f, columns)
+	}
+
+	results, err := e.query.Run(data)
+	if err != nil {
+		return err
+	}
+	if e.template == nil {
+		return writeResults(w, results, f, columns)
+	}
+	for _, r := range results {
+		s, err := compactJSON(r)
+		if err != nil {
+			return err
+		}
+		if err := writeTemplate(w, []byte(s), e.template); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -314,36 +623,87 @@ func (e *ELSCLI) listRulesets(vendorID string) {
 	}
 }
 
-//createAccessKey asks for a password then makes a request to retrieve a new
-// AccessKey for the user. If successful, it outputs the key as it should be
-// declared in a default profile.
-func (e *ELSCLI) createAccessKey(email string, expiryDays int) {
+// requestAccessKey asks for a password then makes a request to retrieve a new
+// AccessKey for the user.
+func (e *ELSCLI) requestAccessKey(email string, expiryDays int) (*els.AccessKey, error) {
+
+	// The password would be sent to the ELS outside of a signed request:
+	if e.dryRunFormat != "" {
+		return nil, ErrDryRunUnsupported
+	}
 
 	password, err := e.pw.GetPassword()
 
 	if err != nil {
-		e.fatalError(err)
-		return
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(e.profile.APITimeoutSecs))
+	ctx, cancel := e.requestContext()
 	defer cancel()
 
 	k, statusCode, err := e.apiCaller.CreateAccessKey(ctx, email, password, false, uint(expiryDays))
+	e.setStatusExitCode(statusCode)
 
-	s := e.outputStream
-	cr := "\n"
+	if err != nil && statusCode == 0 && err != ErrNotRecorded {
+		log.WithFields(log.Fields{"Time": e.tp.Now(), "email": email, "err": err}).Debug("Could not access API")
+		return nil, e.callError(ctx)
+	}
 
 	if statusCode == 401 {
-		fmt.Fprintln(s, "The email address or password are incorrect.")
+		fmt.Fprintln(e.outputStream, "The email address or password are incorrect.")
 		err = errors.New("Request Failed: (StatusCode = " + strconv.Itoa(statusCode) + ")")
 	}
 
+	if err != nil {
+		return nil, err
+	}
+
+	if k.Email == "" {
+		k.Email = email
+	}
+
+	// A key created with no expiry period never expires:
+	if expiryDays <= 0 {
+		k.ExpiryDate = time.Time{}
+	}
+
+	return k, nil
+}
+
+// createAccessKey asks for a password then makes a request to retrieve a new
+// AccessKey for the user. If saveProfile is given, the key is saved in that
+// profile in the config file (replacing the key of an existing profile only if
+// overwrite is set). Otherwise it outputs the key as it should be declared in a
+// default profile.
+func (e *ELSCLI) createAccessKey(email string, expiryDays int, saveProfile string, overwrite bool) {
+
+	if _, ok := e.config.Profiles[saveProfile]; ok && !overwrite {
+		e.fatalError(fmt.Errorf("%s: %s - use --overwrite to replace its Access Key", ErrProfileExists, saveProfile))
+		return
+	}
+
+	k, err := e.requestAccessKey(email, expiryDays)
+
 	if err != nil {
 		e.fatalError(err)
 		return
 	}
 
+	s := e.outputStream
+	cr := "\n"
+
+	if saveProfile != "" {
+		e.config.SetAccessKey(saveProfile, *k)
+
+		if err = e.writeConfig(); err == nil {
+			fmt.Fprintln(s, "Access Key "+string(k.ID)+" created and saved to profile '"+saveProfile+"' in "+e.configFile)
+			return
+		}
+
+		// Don't lose the new key just because the config couldn't be saved:
+		e.fatalError(err)
+	}
+
 	fmt.Fprintln(s, "Access Key Created - shown below in a 'default' profile.")
 	fmt.Fprintln(s, "To sign API calls made by the els-cli with this access key,")
 	fmt.Fprintln(s, "add the profile to ~/.els/els-cli.toml ."+cr)
@@ -355,7 +715,7 @@ func (e *ELSCLI) createAccessKey(email string, expiryDays int) {
 			"\t\tid = \"" + string(k.ID) + `"` + cr +
 			"\t\tsecretAccessKey = \"" + string(k.SecretAccessKey) + `"` + cr
 
-	if expiryDays > 0 {
+	if !k.ExpiryDate.IsZero() {
 		str = str + "\t\texpiryDate = \"" + k.ExpiryDate.UTC().Format(time.RFC3339) + `"` + cr
 	}
 
@@ -370,6 +730,122 @@ func (e *ELSCLI) deleteAccessKey(email string, id els.AccessKeyID) {
 	}
 }
 
+// callAs makes an API call signed by the Access Key in profile p instead of the
+// selected profile, and returns the status code of the response.
+func (e *ELSCLI) callAs(p *Profile, httpMethod string, URL string) (statusCode int, err error) {
+	selected := e.profile
+	e.profile = p
+	defer func() { e.profile = selected }()
+
+	rep, err := e.doCall(httpMethod, URL, "")
+	if err != nil {
+		return 0, err
+	}
+
+	if rep.Body != nil {
+		rep.Body.Close()
+	}
+
+	return rep.StatusCode, nil
+}
+
+// rotateAccessKey replaces the Access Key in the selected profile with a new
+// key, then deletes the old key. The new key is only saved once it has been
+// used to sign an API call successfully. If anything fails before the profile
+// is saved, the new key is deleted again so the profile is left unchanged. The
+// calls are made as the selected profile - to its API, and with any overrides
+// given on the commandline.
+func (e *ELSCLI) rotateAccessKey(email string, expiryDays int) {
+	profileID := e.profileID
+
+	// Keep a copy, as the calls below swap the selected profile:
+	old := &Profile{}
+	*old = *e.profile
+
+	// The els-cli can't update a key given by a process or environment, and
+	// a key saved to the config file would be ignored in favour of it:
+	if old.CredentialProcess != "" || old.SecretAccessKeyEnv != "" || os.Getenv(EnvSecretAccessKey) != "" || os.Getenv(EnvAccessKeyID) != "" {
+		e.fatalError(ErrRotateExternalKey)
+		return
+	}
+
+	if old.AccessKey.ID == "" {
+		e.fatalError(ErrNoAccessKey)
+		return
+	}
+
+	k, err := e.requestAccessKey(email, expiryDays)
+	if err != nil {
+		e.fatalError(err)
+		return
+	}
+
+	// The new key is complete, so mustn't be replaced by the old secret from
+	// the profile's secretAccessKeyFile:
+	newP := *old
+	newP.AccessKey = *k
+	newP.SecretAccessKeyFile = ""
+
+	keysURL := "/users/" + email + "/accessKeys"
+
+	// rollback deletes the new key, signing the call with signer.
+	rollback := func(signer *Profile, err error) {
+		if sc, dErr := e.callAs(signer, "DELETE", keysURL+"/"+string(k.ID)); dErr != nil || sc >= 300 {
+			err = fmt.Errorf("%s - and the new Access Key %s could not be deleted", err, k.ID)
+		}
+		e.fatalError(err)
+	}
+
+	if sc, err := e.callAs(&newP, "GET", keysURL); err != nil || sc >= 300 {
+		rollback(old, ErrKeyVerificationFailed)
+		return
+	}
+
+	if err := e.saveRotatedKey(profileID, old.SecretAccessKeyFile, *k); err != nil {
+		rollback(&newP, err)
+		return
+	}
+
+	fmt.Fprintln(e.outputStream, "Access Key "+string(k.ID)+" created and saved to profile '"+profileID+"' in "+e.configFile)
+
+	// The profile now holds a working key, so a failure from here on must not
+	// undo the rotation:
+	if sc, err := e.callAs(&newP, "DELETE", keysURL+"/"+string(old.AccessKey.ID)); err != nil || sc >= 300 {
+		e.fatalError(fmt.Errorf("The old Access Key %s could not be deleted - delete it with 'accessKeys delete'", old.AccessKey.ID))
+		return
+	}
+
+	fmt.Fprintln(e.outputStream, "Access Key "+string(old.AccessKey.ID)+" deleted")
+}
+
+// saveRotatedKey saves the new key k to the profile, where the key is defined so
+// profiles sharing it get it too. If the profile reads its secret from
+// secretFile, the new secret is written there rather than to the config file.
+// If the config file can't be written, secretFile is restored.
+func (e *ELSCLI) saveRotatedKey(profileID string, secretFile string, k els.AccessKey) error {
+	if secretFile == "" {
+		e.config.SetAccessKey(e.config.AccessKeyOwner(profileID), k)
+		return e.writeConfig()
+	}
+
+	oldSecret, err := afero.ReadFile(e.fs, secretFile)
+	if err != nil {
+		return err
+	}
+	if err := afero.WriteFile(e.fs, secretFile, []byte(string(k.SecretAccessKey)+"\n"), 0600); err != nil {
+		return err
+	}
+
+	k.SecretAccessKey = ""
+	e.config.SetAccessKey(e.config.AccessKeyOwner(profileID), k)
+
+	if err := e.writeConfig(); err != nil {
+		afero.WriteFile(e.fs, secretFile, oldSecret, 0600)
+		return err
+	}
+	return nil
+}
+
 // listAccessKeys lists the AccessKeys relating to a user
 func (e *ELSCLI) listAccessKeys(email string) {
 	if err := e.doCallAndRep("GET", "/users/"+email+"/accessKeys", ""); err != nil {
@@ -409,26 +885,29 @@ func (e *ELSCLI) doGetEULALicenseInfringements(vendorID string, year, month int)
 
 	path := fmt.Sprintf("/vendors/%s/customerLicenceEulaInfringements/month/%d/%d", vendorID, year, month)
 
-	csvWriter := csv.NewWriter(e.outputStream)
-	records := [][]string{
-		[]string{
-			"elsCustomerID",
-			"vendorCustomerID",
-			"eulaPeriod",
-			"year",
-			"month",
-			"eulaPolicyID",
-			"featureID",
-			"licenseSetID",
-			"licenseIndex",
-			"numUsers",
-		}}
+	columns := []string{
+		"elsCustomerID",
+		"vendorCustomerID",
+		"eulaPeriod",
+		"year",
+		"month",
+		"eulaPolicyID",
+		"featureID",
+		"licenseSetID",
+		"licenseIndex",
+		"numUsers",
+	}
+	records := []interface{}{}
 
 	cursor := ""
 
 	for {
 		cir, err := e.getInfringementPage(path, cursor)
 
+		if err == errDryRun {
+			return nil
+		}
+
 		if err != nil {
 			return err
 		}
@@ -438,18 +917,23 @@ func (e *ELSCLI) doGetEULALicenseInfringements(vendorID string, year, month int)
 		for _, ci := range cir.CustomerInfringements {
 			for _, i := range ci.Infringements {
 
-				records = append(records, []string{
+				values := []interface{}{
 					ci.ELSCustomerID,
 					ci.VendorCustomerID,
 					i.EULAPeriod,
-					strconv.Itoa(i.Year),
-					strconv.Itoa(i.Month),
+					json.Number(strconv.Itoa(i.Year)),
+					json.Number(strconv.Itoa(i.Month)),
 					i.EULAPolicyID,
 					i.FeatureID,
 					i.LicenseSetID,
-					strconv.Itoa(i.LicenseIndex),
-					strconv.Itoa(i.NumUsers),
-				})
+					json.Number(strconv.Itoa(i.LicenseIndex)),
+					json.Number(strconv.Itoa(i.NumUsers)),
+				}
+				r := jsonObject{}
+				for c, v := range values {
+					r = append(r, jsonField{Key: columns[c], Value: v})
+				}
+				records = append(records, r)
 			}
 		}
 
@@ -458,8 +942,24 @@ func (e *ELSCLI) doGetEULALicenseInfringements(vendorID string, year, month int)
 		}
 	}
 
-	csvWriter.WriteAll(records)
-	return nil
+	// The report is CSV unless another format is requested:
+	f := e.format
+	if f == "" {
+		f = FormatCSV
+	}
+	if len(e.columns) > 0 {
+		columns = e.columns
+	}
+
+	data, err := compactJSON(records)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := e.writeBody(&b, []byte(data), f, columns); err != nil {
+		return err
+	}
+	return e.writeOut(b.Bytes())
 }
 
 // getInfringementPage gets a single page of CustomerEULAInfringements results,
@@ -482,6 +982,7 @@ func (e *ELSCLI) getInfringementPage(url, cursor string) (i *CustomerEULAInfring
 	}
 
 	if rep.StatusCode != 200 {
+		e.setStatusExitCode(rep.StatusCode)
 		return nil, ErrUnexpectedResponse
 	}
 
@@ -660,10 +1161,19 @@ func userCommands(userC *cli.Cmd) {
 
 	userC.Command("accessKeys", "Manage Access Keys", func(accessKeysC *cli.Cmd) {
 		accessKeysC.Command("create", "Create a new API Access Key", func(c *cli.Cmd) {
-			c.Spec = "[EXPIRYDAYS]"
+			c.Spec = "[--save-profile [--overwrite]] [EXPIRYDAYS]"
+			saveProfile := c.StringOpt("save-profile", "", "Save the new key in this profile in the config file instead of showing it")
+			overwrite := c.BoolOpt("overwrite", false, "Replace the Access Key of the profile given by --save-profile if it already exists")
 			expiryDays := c.IntArg("EXPIRYDAYS", 30, "Number of days before expiry.")
 			c.Action = func() {
-				gApp.createAccessKey(*email, *expiryDays)
+				gApp.createAccessKey(*email, *expiryDays, *saveProfile, *overwrite)
+			}
+		})
+		accessKeysC.Command("rotate", "Replace the Access Key in the selected profile (see --profile) with a new key, then delete the old key", func(c *cli.Cmd) {
+			c.Spec = "[EXPIRYDAYS]"
+			expiryDays := c.IntArg("EXPIRYDAYS", 30, "Number of days before the new key expires.")
+			c.Action = func() {
+				gApp.rotateAccessKey(*email, *expiryDays)
 			}
 		})
 		accessKeysC.Command("delete", "Delete an API Access Key", func(c *cli.Cmd) {
@@ -680,27 +1190,130 @@ func userCommands(userC *cli.Cmd) {
 	})
 }
 
+// overrides holds settings given on the commandline or via environment
+// variables, which take precedence over those in the selected profile. Empty
+// values don't override anything.
+type overrides struct {
+	output        string
+	apiURL        string
+	timeoutSecs   int
+	maxTries      int
+	httpProxy     string
+	noProxy       string
+	caBundle      string
+	clientCert    string
+	clientKey     string
+	minTLSVersion string
+}
+
 // initProfile identifies which profile from the config should be used for
-// default values (if any is set). An optional output o can be used to override
-// the default output in the profile.
-func (e *ELSCLI) initProfile(p string, o string) (err error) {
+// default values (if any is set). The overrides o are applied to a copy of the
+// profile, so the config itself is unchanged.
+func (e *ELSCLI) initProfile(p string, o overrides) (err error) {
+
+	e.profileID = p
+	prof, err := e.config.Profile(p)
 
-	e.profile, err = e.config.Profile(p)
+	selected := *prof
+	e.profile = &selected
+	e.profile.SetDefaults()
 
 	// We don't expect people to have a config file so if the default profile
-	// doesn't exist in the config, don't flag the error.
+	// doesn't exist in the config, don't flag the error - the profile can be
+	// defined entirely by environment variables. Any other unknown profile is
+	// reported by the commands which use the profile (see requireProfile).
+	e.profileErr = nil
 	if err != nil && p != "default" {
-		return ErrProfileNotFound
+		e.profileErr = e.config.unknownProfileError(p)
+	}
+	if err, ok := e.config.invalid[p]; ok {
+		e.profileErr = fmt.Errorf("%s: profiles.%s: %s", ErrInvalidConfig, p, err)
+	}
+
+	if err := e.profile.ApplyEnv(); err != nil {
+		return err
 	}
 
 	// overrides
-	if o != "" {
-		e.profile.Output = o
+	if o.output != "" {
+		e.profile.Output = o.output
+	}
+
+	if o.apiURL != "" {
+		if err := ValidAPIURL(o.apiURL); err != nil {
+			return err
+		}
+		e.profile.APIURL = o.apiURL
+	}
+
+	if o.timeoutSecs < 0 {
+		return fmt.Errorf("%s: --timeout", ErrInvalidValue)
+	}
+	if o.timeoutSecs > 0 {
+		e.profile.APITimeoutSecs = o.timeoutSecs
 	}
 
+	if o.maxTries < 0 {
+		return fmt.Errorf("%s: --max-tries", ErrInvalidValue)
+	}
+	if o.maxTries > 0 {
+		e.profile.MaxAPITries = o.maxTries
+	}
+
+	network := []struct{ key, flag, value string }{
+		{KeyHTTPProxy, "--proxy", o.httpProxy},
+		{KeyNoProxy, "--no-proxy", o.noProxy},
+		{KeyCABundle, "--ca-bundle", o.caBundle},
+		{KeyClientCert, "--client-cert", o.clientCert},
+		{KeyClientKey, "--client-key", o.clientKey},
+		{KeyMinTLSVersion, "--min-tls-version", o.minTLSVersion},
+	}
+	for _, n := range network {
+		if n.value == "" {
+			continue
+		}
+		if err := e.profile.Set(n.key, n.value); err != nil {
+			return fmt.Errorf("%s: %s", err, n.flag)
+		}
+	}
+
+	e.limiter = NewRateLimiter(e.profile.MaxRequestsPerSecond, e.profile.Burst, e.tp)
+
 	return nil
 }
 
+// initAPICaller creates the APICaller which makes calls to the ELS API given by
+// the selected profile, unless an APICaller was supplied to the app. The calls
+// are recorded with --record, or replayed instead with --replay.
+func (e *ELSCLI) initAPICaller() (err error) {
+	if e.replayFile != "" {
+		e.apiCaller, err = newReplayer(e.fs, e.replayFile)
+		return err
+	}
+
+	if e.apiCaller == nil {
+		// Bad network settings are only reported by commands which call the
+		// API, so that they can still be fixed with the config commands:
+		t, err := e.profile.Transport(e.fs)
+		if err != nil {
+			if e.profileErr == nil {
+				e.profileErr = err
+			}
+			return nil
+		}
+
+		timeout := time.Second * time.Duration(e.profile.APITimeoutSecs)
+		c := &http.Client{Transport: t, Timeout: timeout}
+		e.apiCaller = els.NewEDAPICaller(c, e.tp, timeout, e.profile.APIURL)
+	}
+
+	if e.recordFile != "" {
+		e.apiCaller, err = newRecorder(e.apiCaller, e.fs, e.recordFile)
+	}
+
+	return err
+}
+
 // initLog configures logrus to create rotating logs within the user's .els
 // directory.
 func (e *ELSCLI) initLog() error {
@@ -721,6 +1334,32 @@ func (e *ELSCLI) initLog() error {
 	return nil
 }
 
+// abortRun is used as a panic value by abort to stop the cli framework from
+// running a command. It is recovered by Run.
+type abortRun struct{}
+
+// abort stops the selected command from running, e.g. because a fatal error
+// was found before it started. It must only be called from within Run.
+func (e *ELSCLI) abort() {
+	panic(abortRun{})
+}
+
+// requireProfile returns an initialiser for a family of commands which only
+// run if the profile selected via --profile exists, so that API calls are never
+// made with the wrong identity.
+func requireProfile(init cli.CmdInitializer) cli.CmdInitializer {
+	return func(c *cli.Cmd) {
+		c.Before = func() {
+			if gApp.profileErr != nil {
+				gApp.setExitCode(ExitUsage)
+				gApp.fatalError(gApp.profileErr)
+				gApp.abort()
+			}
+		}
+		init(c)
+	}
+}
+
 // init sets up the app prior to parsing the commandline.
 func (e *ELSCLI) init() error {
 	if err := e.initLog(); err != nil {
@@ -743,17 +1382,198 @@ func (e *ELSCLI) init() error {
 	output := a.String(cli.StringOpt{
 		Name:   "o output",
 		Value:  "",
-		Desc:   "Overrides the output format defined in the profile: Must be: wholeResponse|bodyOnly|statusCodeOnly",
-		EnvVar: "ELSCLI_OUTPUT",
+		Desc:   "Overrides the output format defined in the profile: Must be: wholeResponse|bodyOnly|statusCodeOnly|withHeaders",
+		EnvVar: EnvOutput,
+	})
+	include := a.Bool(cli.BoolOpt{
+		Name:  "i include",
+		Value: false,
+		Desc:  "Writes the status line and response headers before the body - the same as --output withHeaders",
+	})
+	headerOnly := a.String(cli.StringOpt{
+		Name:  "header-only",
+		Value: "",
+		Desc:  "Writes only the value of the named response header - e.g. ETag",
+	})
+	apiURL := a.String(cli.StringOpt{
+		Name:   "api-url",
+		Value:  "",
+		Desc:   "Overrides the root URL of the ELS API defined in the profile - e.g. to use a staging deployment",
+		EnvVar: "ELSCLI_API_URL",
+	})
+	timeoutSecs := a.Int(cli.IntOpt{
+		Name:      "timeout",
+		Value:     0,
+		HideValue: true,
+		Desc:      "Overrides how many seconds to wait for each API call to complete, as defined in the profile",
+	})
+	maxTries := a.Int(cli.IntOpt{
+		Name:      "max-tries",
+		Value:     0,
+		HideValue: true,
+		Desc:      "Overrides how many times to try an API call before giving up, as defined in the profile",
+	})
+	verbose := a.Bool(cli.BoolOpt{
+		Name:   "verbose trace",
+		Value:  false,
+		Desc:   "Write each API call and its response to stderr, with secrets redacted",
+		EnvVar: "ELSCLI_VERBOSE",
+	})
+	dryRun := a.Bool(cli.BoolOpt{
+		Name:  "dry-run",
+		Value: false,
+		Desc:  "Sign each API call and write it to stdout instead of sending it",
+	})
+	dryRunFormat := a.String(cli.StringOpt{
+		Name:  "dry-run-format",
+		Value: DryRunCurl,
+		Desc:  "How --dry-run writes each API call: curl|http|json",
+	})
+	record := a.String(cli.StringOpt{
+		Name:  "record",
+		Value: "",
+		Desc:  "Record each API call and its response, with secrets redacted, to this file",
+	})
+	replay := a.String(cli.StringOpt{
+		Name:  "replay",
+		Value: "",
+		Desc:  "Respond to each API call from this file, made with --record, instead of calling the ELS",
+	})
+	httpProxy := a.String(cli.StringOpt{
+		Name:   "proxy",
+		Value:  "",
+		Desc:   "Overrides the URL of the proxy through which API calls are made, as defined in the profile",
+		EnvVar: "ELSCLI_PROXY",
+	})
+	noProxy := a.String(cli.StringOpt{
+		Name:  "no-proxy",
+		Value: "",
+		Desc:  "Overrides the comma-separated hosts which are called without the proxy, as defined in the profile",
+	})
+	caBundle := a.String(cli.StringOpt{
+		Name:   "ca-bundle",
+		Value:  "",
+		Desc:   "Overrides the file of PEM encoded CA certificates to trust, as defined in the profile",
+		EnvVar: "ELSCLI_CA_BUNDLE",
+	})
+	clientCert := a.String(cli.StringOpt{
+		Name:  "client-cert",
+		Value: "",
+		Desc:  "Overrides the PEM encoded TLS client certificate file, as defined in the profile",
+	})
+	clientKey := a.String(cli.StringOpt{
+		Name:  "client-key",
+		Value: "",
+		Desc:  "Overrides the PEM encoded TLS client key file, as defined in the profile",
+	})
+	minTLSVersion := a.String(cli.StringOpt{
+		Name:  "min-tls-version",
+		Value: "",
+		Desc:  "Overrides the lowest TLS version which may be used, as defined in the profile: 1.0|1.1|1.2|1.3",
+	})
+	format := a.String(cli.StringOpt{
+		Name:   "format",
+		Value:  "",
+		Desc:   "How to write response bodies: json|json-compact|yaml|table|csv|jsonl",
+		EnvVar: "ELSCLI_FORMAT",
+	})
+	columns := a.String(cli.StringOpt{
+		Name:  "columns",
+		Value: "",
+		Desc:  "The comma-separated columns to write with --format table or csv - e.g. id,name",
+	})
+	query := a.String(cli.StringOpt{
+		Name:  "query",
+		Value: "",
+		Desc:  "A jq-style filter to apply to response bodies before they are written - e.g. '.rulesets[].id'",
+	})
+	tmpl := a.String(cli.StringOpt{
+		Name:  "template",
+		Value: "",
+		Desc:  "A Go text/template with which to render response bodies, in place of --format - e.g. '{{range .}}{{.id}}{{\"\\n\"}}{{end}}'",
+	})
+	tmplFile := a.String(cli.StringOpt{
+		Name:  "template-file",
+		Value: "",
+		Desc:  "A file containing the template with which to render response bodies",
+	})
+	out := a.String(cli.StringOpt{
+		Name:  "out",
+		Value: "",
+		Desc:  "A file to which to write response bodies, rather than stdout - needed to save binary responses from a terminal",
 	})
 	a.Before = func() {
-		e.initProfile(*prof, *output)
+		e.verbose = *verbose
+		if *format != "" && !ValidFormat(*format) {
+			e.setExitCode(ExitUsage)
+			e.fatalError(ErrInvalidFormat)
+			e.abort()
+		}
+		e.format, e.columns = *format, parseColumns(*columns)
+		e.query = nil
+		if *query != "" {
+			q, err := ParseQuery(*query)
+			if err != nil {
+				e.setExitCode(ExitUsage)
+				e.fatalError(err)
+				e.abort()
+			}
+			e.query = q
+		}
+		e.outFile, e.headerOnly = *out, *headerOnly
+		if err := e.initTemplate(*tmpl, *tmplFile); err != nil {
+			e.setExitCode(ExitUsage)
+			e.fatalError(err)
+			e.abort()
+		}
+		e.recordFile, e.replayFile = *record, *replay
+		if e.recordFile != "" && e.replayFile != "" {
+			e.setExitCode(ExitUsage)
+			e.fatalError(ErrRecordAndReplay)
+			e.abort()
+		}
+		e.dryRunFormat = ""
+		if *dryRun {
+			if !ValidDryRunFormat(*dryRunFormat) {
+				e.setExitCode(ExitUsage)
+				e.fatalError(ErrInvalidDryRunFormat)
+				e.abort()
+			}
+			e.dryRunFormat = *dryRunFormat
+		}
+		o := overrides{
+			output:        *output,
+			apiURL:        *apiURL,
+			timeoutSecs:   *timeoutSecs,
+			maxTries:      *maxTries,
+			httpProxy:     *httpProxy,
+			noProxy:       *noProxy,
+			caBundle:      *caBundle,
+			clientCert:    *clientCert,
+			clientKey:     *clientKey,
+			minTLSVersion: *minTLSVersion,
+		}
+		if *include {
+			o.output = OutputWithHeaders
+		}
+		if err := e.initProfile(*prof, o); err != nil {
+			e.setExitCode(ExitUsage)
+			e.fatalError(err)
+			e.abort()
+		}
+		if err := e.initAPICaller(); err != nil {
+			e.fatalError(err)
+			e.abort()
+		}
 	}
 
-	a.Command("users", "User API", userCommands)
-	a.Command("vendors", "Vendor API", vendorCommands)
-	a.Command("cloud-providers", "Cloud Provider API", cloudProviderCommands)
-	a.Command("do", "Make any call to the API", genericCommands)
+	a.Command("users", "User API", requireProfile(userCommands))
+	a.Command("vendors", "Vendor API", requireProfile(vendorCommands))
+	a.Command("cloud-providers", "Cloud Provider API", requireProfile(cloudProviderCommands))
+	a.Command("do", "Make any call to the API", requireProfile(genericCommands))
+	a.Command("serve-proxy", "Sign calls from other tools and forward them to the API", requireProfile(proxyCommands))
+	a.Command("mock-server", "Serve a mock ELS API from JSON fixtures, for offline development", mockServerCommands)
+	a.Command("config", "Manage the profiles in ~/.els/els-cli.toml", configCommands)
 
 	return nil
 }
@@ -762,12 +1582,42 @@ func (e *ELSCLI) init() error {
 // command. It returns any fatal errors - e.g. configuration errors or usage
 // errors. It does not return an error if a request failed because of ELS
 // permissions (for example)
-func (e *ELSCLI) Run(cliArgs []string) error {
+func (e *ELSCLI) Run(cliArgs []string) (err error) {
 
 	if err := e.init(); err != nil {
 		return err
 	}
 
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(abortRun); !ok {
+				panic(r)
+			}
+			err = e.fatalErr
+		}
+	}()
+
+	// Cancel any API call in progress if the els-cli is interrupted. The handler
+	// is removed after the first signal, so a second Ctrl-C kills the process if
+	// it doesn't stop promptly:
+	ctx, cancel := context.WithCancel(e.ctx)
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	go func() {
+		select {
+		case <-sigs:
+			signal.Stop(sigs)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	e.ctx = ctx
+
 	e.fApp.Run(cliArgs)
 
 	return e.fatalErr
@@ -2,8 +2,14 @@ package main_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/elasticlic/els-api-sdk-go/els"
@@ -101,8 +107,19 @@ var _ = Describe("els_cliTest Suite", func() {
 				}
 			}
 
-			checkRequest = func(httpMethod string, URL string) {
-				r := ac.GetCall(0).ACArgs.Req
+			// readConfig reads back the config file written by the els-cli.
+			readConfig = func() *cli.Config {
+				f, err := fs.Open(cFile)
+				Expect(err).To(BeNil())
+				defer f.Close()
+				c, err := cli.ReadTOML(f)
+				Expect(err).To(BeNil())
+				return c
+			}
+
+			// checkRequestN checks the method and URL of the n'th call made.
+			checkRequestN = func(n int, httpMethod string, URL string) {
+				r := ac.GetCall(n).ACArgs.Req
 				Expect(httpMethod).To(Equal(r.Method))
 
 				u := r.URL
@@ -113,6 +130,10 @@ var _ = Describe("els_cliTest Suite", func() {
 				}
 			}
 
+			checkRequest = func(httpMethod string, URL string) {
+				checkRequestN(0, httpMethod, URL)
+			}
+
 			// initAPIResponse sets a simple expectation on an APICaller method
 			// being invoked and a response returned.
 			initResponse = func(callMethod string, statusCode int, repJson string) {
@@ -120,6 +141,13 @@ var _ = Describe("els_cliTest Suite", func() {
 					ACRep: em.ACRep{Rep: em.HTTPResponse(statusCode, repJson)},
 				})
 			}
+
+			// run sets the global options, and gets the list of rulesets.
+			run = func(opts ...string) {
+				BeforeEach(func() {
+					args = append(append(args, opts...), "do", "GET", "vendors/"+vendorID+"/paygRuleSets")
+				})
+			}
 		)
 
 		BeforeEach(func() {
@@ -132,7 +160,7 @@ var _ = Describe("els_cliTest Suite", func() {
 
 			outS = bytes.Buffer{}
 			errS = bytes.Buffer{}
-			config.Profiles = make(map[string]*cli.Profile)
+			config = cli.Config{Profiles: make(map[string]*cli.Profile)}
 			config.Profiles["default"] = &cli.Profile{
 				AccessKey:   accessKey,
 				MaxAPITries: maxAPITries,
@@ -196,6 +224,892 @@ var _ = Describe("els_cliTest Suite", func() {
 			})
 		})
 
+		Describe("API URL", func() {
+			var (
+				server *httptest.Server
+				path   string
+			)
+			BeforeEach(func() {
+				path = ""
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					path = r.URL.Path
+					w.Write([]byte(repJ))
+				}))
+				sut = cli.NewELSCLI(fr, &config, cFile, tp, fs, nil, pipe, pwr, &outS, &errS)
+				args = append(args, "do", "GET", "vendors/"+vendorID)
+			})
+			AfterEach(func() {
+				server.Close()
+			})
+			Context("The profile defines the API URL", func() {
+				BeforeEach(func() {
+					prof.APIURL = server.URL
+				})
+				It("Makes the call to that API", func() {
+					Expect(path).To(HaveSuffix("/vendors/" + vendorID))
+					checkOutputJSON(repJ)
+				})
+			})
+			Context("--api-url is given", func() {
+				BeforeEach(func() {
+					prof.APIURL = "https://unused.example.com"
+					args = append([]string{"els-cli", "--api-url", server.URL}, args[1:]...)
+				})
+				It("Makes the call to that API", func() {
+					Expect(path).To(HaveSuffix("/vendors/" + vendorID))
+					checkOutputJSON(repJ)
+				})
+			})
+		})
+
+		Describe("Timeouts", func() {
+			var (
+				server   *httptest.Server
+				requests int
+				delay    time.Duration
+			)
+			BeforeEach(func() {
+				requests = 0
+				delay = 0
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					select {
+					case <-time.After(delay):
+					case <-r.Context().Done():
+					}
+					w.Write([]byte(repJ))
+				}))
+				prof.APIURL = server.URL
+				sut = cli.NewELSCLI(fr, &config, cFile, tp, fs, nil, pipe, pwr, &outS, &errS)
+				args = append(args, "--timeout", "1", "--max-tries", "2", "do", "GET", "vendors/"+vendorID)
+			})
+			AfterEach(func() {
+				server.Close()
+			})
+			Context("The API responds in time", func() {
+				It("Outputs the response", func() {
+					Expect(fatalErr).To(BeNil())
+					checkOutputJSON(repJ)
+				})
+			})
+			Context("The API doesn't respond in time", func() {
+				BeforeEach(func() {
+					delay = time.Second * 3
+				})
+				It("Gives up after each try times out", func() {
+					Expect(fatalErr).To(Equal(cli.ErrAPITimeout))
+					Expect(requests).To(Equal(2))
+				})
+			})
+			Context("An invalid timeout is given", func() {
+				BeforeEach(func() {
+					args = append([]string{"els-cli", "--timeout=-1"}, args[3:]...)
+				})
+				It("Reports the error", func() {
+					Expect(fatalErr.Error()).To(HavePrefix(cli.ErrInvalidValue.Error()))
+					Expect(requests).To(BeZero())
+				})
+			})
+		})
+
+		Describe("Retries", func() {
+			var (
+				server     *httptest.Server
+				statusCode []int
+				retryAfter string
+				bodies     []string
+			)
+			BeforeEach(func() {
+				bodies = nil
+				retryAfter = ""
+				statusCode = []int{http.StatusTooManyRequests, http.StatusOK}
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					b, _ := ioutil.ReadAll(r.Body)
+					bodies = append(bodies, string(b))
+					if retryAfter != "" {
+						w.Header().Set("Retry-After", retryAfter)
+					}
+					w.WriteHeader(statusCode[len(bodies)-1])
+					w.Write([]byte(repJ))
+				}))
+				prof.APIURL = server.URL
+				prof.MaxAPITries = 2
+				pipe.Data = reqJ
+				sut = cli.NewELSCLI(fr, &config, cFile, tp, fs, nil, pipe, pwr, &outS, &errS)
+				args = append(args, "vendors", vendorID, "put")
+			})
+			AfterEach(func() {
+				server.Close()
+			})
+			Context("The API is busy", func() {
+				It("Retries, sending the same body", func() {
+					Expect(fatalErr).To(BeNil())
+					Expect(bodies).To(Equal([]string{reqJ, reqJ}))
+					checkOutputJSON(repJ)
+				})
+			})
+			Context("The API asks for a delay with Retry-After", func() {
+				var start time.Time
+				BeforeEach(func() {
+					retryAfter = "1"
+					start = time.Now()
+				})
+				It("Waits before retrying", func() {
+					Expect(len(bodies)).To(Equal(2))
+					Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+				})
+			})
+			Context("The API is unavailable", func() {
+				BeforeEach(func() {
+					statusCode = []int{http.StatusServiceUnavailable, http.StatusOK}
+				})
+				It("Doesn't retry by default", func() {
+					Expect(len(bodies)).To(Equal(1))
+				})
+				Context("The profile retries server errors", func() {
+					BeforeEach(func() {
+						prof.RetryServerErrors = true
+					})
+					It("Retries", func() {
+						Expect(len(bodies)).To(Equal(2))
+						checkOutputJSON(repJ)
+					})
+				})
+			})
+		})
+
+		Describe("Rate limiting", func() {
+			var (
+				server   *httptest.Server
+				requests int
+			)
+			BeforeEach(func() {
+				requests = 0
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					cursor := ""
+					if requests < 3 {
+						cursor = "page" + strconv.Itoa(requests)
+					}
+					w.Write([]byte(`{"cursor":"` + cursor + `","customerInfringements":[]}`))
+				}))
+				prof.APIURL = server.URL
+				prof.MaxRequestsPerSecond = 5
+				prof.Burst = 1
+				sut = cli.NewELSCLI(fr, &config, cFile, tp, fs, nil, pipe, pwr, &outS, &errS)
+				args = append(args, "vendors", vendorID, "get-eula-license-infringements", "2018", "7")
+			})
+			AfterEach(func() {
+				server.Close()
+			})
+			It("Makes all the calls through the limiter", func() {
+				Expect(fatalErr).To(BeNil())
+				Expect(requests).To(Equal(3))
+			})
+		})
+
+		Describe("Verbose", func() {
+			var server *httptest.Server
+			BeforeEach(func() {
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("X-Request-Id", "req1")
+					w.Write([]byte(`{"email":"a@example.com","password":"hunter2"}`))
+				}))
+				prof.APIURL = server.URL
+				pipe.Data = `{"password":"swordfish"}`
+				sut = cli.NewELSCLI(fr, &config, cFile, tp, fs, nil, pipe, pwr, &outS, &errS)
+				args = append(args, "--verbose", "vendors", vendorID, "put")
+			})
+			AfterEach(func() {
+				server.Close()
+			})
+			It("Writes the request and response to stderr", func() {
+				Expect(fatalErr).To(BeNil())
+				Expect(errS.String()).To(ContainSubstring("> PUT " + server.URL))
+				Expect(errS.String()).To(ContainSubstring("> Authorization: ELS [REDACTED]"))
+				Expect(errS.String()).To(ContainSubstring("< 200 OK"))
+				Expect(errS.String()).To(ContainSubstring("< X-Request-Id: req1"))
+				Expect(errS.String()).To(ContainSubstring(`"email":"a@example.com"`))
+			})
+			It("Redacts secrets", func() {
+				Expect(errS.String()).NotTo(ContainSubstring(string(prof.AccessKey.ID)))
+				Expect(errS.String()).NotTo(ContainSubstring(string(prof.AccessKey.SecretAccessKey)))
+				Expect(errS.String()).NotTo(ContainSubstring("swordfish"))
+				Expect(errS.String()).NotTo(ContainSubstring("hunter2"))
+			})
+			It("Still outputs the response", func() {
+				Expect(outS.String()).To(ContainSubstring("hunter2"))
+			})
+			Context("The response is binary", func() {
+				BeforeEach(func() {
+					server.Close()
+					server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						w.Header().Set("Content-Type", "application/pdf")
+						w.Write([]byte("%PDF-1.4\x00\x01"))
+					}))
+					prof.APIURL = server.URL
+				})
+				It("Writes a summary of the body to stderr", func() {
+					Expect(fatalErr).To(BeNil())
+					Expect(errS.String()).To(ContainSubstring("< <10 bytes application/pdf>\n"))
+					Expect(errS.String()).NotTo(ContainSubstring("%PDF"))
+				})
+			})
+			Context("The API doesn't respond in time", func() {
+				var traced string
+				BeforeEach(func() {
+					server.Close()
+					server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						traced = errS.String()
+						time.Sleep(time.Millisecond * 1500)
+					}))
+					prof.APIURL = server.URL
+					args = append([]string{"els-cli", "--timeout", "1"}, args[1:]...)
+				})
+				It("Writes the request to stderr before it is answered", func() {
+					Expect(fatalErr).To(Equal(cli.ErrAPITimeout))
+					Expect(traced).To(ContainSubstring("> PUT " + server.URL))
+					Expect(traced).To(ContainSubstring("> Authorization: ELS [REDACTED]"))
+				})
+			})
+			Context("The API can't be reached", func() {
+				BeforeEach(func() {
+					server.Close()
+				})
+				It("Writes the transport error to stderr", func() {
+					Expect(fatalErr).To(Equal(cli.ErrAPIUnreachable))
+					Expect(errS.String()).To(ContainSubstring("connection refused"))
+				})
+			})
+		})
+
+		Describe("Dry run", func() {
+			var (
+				server   *httptest.Server
+				requests int
+			)
+			BeforeEach(func() {
+				requests = 0
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					w.Write([]byte(repJ))
+				}))
+				prof.APIURL = server.URL
+				pipe.Data = reqJ
+				sut = cli.NewELSCLI(fr, &config, cFile, tp, fs, nil, pipe, pwr, &outS, &errS)
+				args = append(args, "--dry-run")
+			})
+			AfterEach(func() {
+				server.Close()
+			})
+			Context("A call is made", func() {
+				BeforeEach(func() {
+					args = append(args, "vendors", vendorID, "put")
+				})
+				It("Writes the signed call as a curl command without sending it", func() {
+					Expect(fatalErr).To(BeNil())
+					Expect(requests).To(BeZero())
+					Expect(outS.String()).To(HavePrefix("curl -X PUT '" + server.URL + "/vendors/" + vendorID + "'"))
+					Expect(outS.String()).To(ContainSubstring("-H 'Authorization: ELS "))
+					Expect(outS.String()).To(ContainSubstring("--data-binary '" + reqJ + "'"))
+				})
+				Context("The call is written as HTTP", func() {
+					BeforeEach(func() {
+						args = append([]string{"els-cli", "--dry-run-format", "http"}, args[1:]...)
+					})
+					It("Writes the call as it would be sent", func() {
+						Expect(outS.String()).To(HavePrefix("PUT /vendors/" + vendorID + " HTTP/1.1\r\n"))
+						Expect(outS.String()).To(ContainSubstring("Authorization: ELS "))
+						Expect(outS.String()).To(HaveSuffix(reqJ))
+					})
+				})
+				Context("The call is written as JSON", func() {
+					BeforeEach(func() {
+						args = append([]string{"els-cli", "--dry-run-format", "json"}, args[1:]...)
+					})
+					It("Writes the call as a JSON object", func() {
+						r := struct {
+							Method  string
+							URL     string
+							Headers map[string]string
+							Body    string
+						}{}
+						Expect(json.Unmarshal(outS.Bytes(), &r)).To(Succeed())
+						Expect(r.Method).To(Equal("PUT"))
+						Expect(r.URL).To(Equal(server.URL + "/vendors/" + vendorID))
+						Expect(r.Headers).To(HaveKey("Authorization"))
+						Expect(r.Body).To(Equal(reqJ))
+					})
+				})
+				Context("An invalid format is given", func() {
+					BeforeEach(func() {
+						args = append([]string{"els-cli", "--dry-run-format", "wget"}, args[1:]...)
+					})
+					It("Reports the error", func() {
+						Expect(fatalErr).To(Equal(cli.ErrInvalidDryRunFormat))
+						Expect(sut.ExitCode()).To(Equal(cli.ExitUsage))
+					})
+				})
+			})
+			Context("An access key is created", func() {
+				BeforeEach(func() {
+					args = append(args, "users", email, "accessKeys", "create")
+				})
+				It("Refuses, as the password would be sent", func() {
+					Expect(fatalErr).To(Equal(cli.ErrDryRunUnsupported))
+					Expect(requests).To(BeZero())
+				})
+			})
+		})
+
+		Describe("Record and replay", func() {
+			var (
+				server   *httptest.Server
+				requests int
+				repBody  string
+				cassette = "cassette.json"
+			)
+			BeforeEach(func() {
+				requests = 0
+				repBody = repJ
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					w.Write([]byte(repBody))
+				}))
+				prof.APIURL = server.URL
+				pipe.Data = reqJ
+				sut = cli.NewELSCLI(fr, &config, cFile, tp, fs, nil, pipe, pwr, &outS, &errS)
+				args = append(args, "--record", cassette, "vendors", vendorID, "put")
+			})
+			AfterEach(func() {
+				server.Close()
+			})
+
+			// replay runs the recorded command again with --replay, and
+			// returns its output and error.
+			replay := func(a ...string) (string, error) {
+				server.Close()
+				var o, e bytes.Buffer
+				p := &MockPipe{Data: reqJ}
+				r := cli.NewELSCLI(jcli.App("els-cli", ""), &config, cFile, tp, fs, nil, p, pwr, &o, &e)
+				err := r.Run(append([]string{"els-cli", "--replay", cassette}, a...))
+				return o.String(), err
+			}
+
+			It("Records the call and its response", func() {
+				Expect(fatalErr).To(BeNil())
+				data, err := afero.ReadFile(fs, cassette)
+				Expect(err).To(BeNil())
+				Expect(string(data)).To(ContainSubstring(`"path": "/vendors/` + vendorID + `"`))
+				Expect(string(data)).To(ContainSubstring("ELS [REDACTED]"))
+				Expect(string(data)).NotTo(ContainSubstring(string(accessKey.SecretAccessKey)))
+			})
+			It("Replays the response without calling the API", func() {
+				out, err := replay("vendors", vendorID, "put")
+				Expect(err).To(BeNil())
+				Expect(out).To(Equal(outS.String()))
+				Expect(requests).To(Equal(1))
+			})
+			It("Reports a call which wasn't recorded", func() {
+				_, err := replay("vendors", vendorID, "get")
+				Expect(err.Error()).To(HavePrefix(cli.ErrNotRecorded.Error()))
+			})
+			Context("The response is binary", func() {
+				BeforeEach(func() {
+					repBody = "%PDF-1.4\x00\xff\xfe"
+				})
+				It("Records it base64 encoded, and replays it unchanged", func() {
+					data, err := afero.ReadFile(fs, cassette)
+					Expect(err).To(BeNil())
+					Expect(string(data)).To(ContainSubstring(`"bodyEncoding": "base64"`))
+
+					out, err := replay("vendors", vendorID, "put")
+					Expect(err).To(BeNil())
+					Expect(out).To(Equal(repBody))
+					Expect(outS.String()).To(Equal(repBody))
+				})
+			})
+			Context("Both --record and --replay are given", func() {
+				BeforeEach(func() {
+					args = append([]string{"els-cli", "--replay", cassette}, args[1:]...)
+				})
+				It("Reports the error", func() {
+					Expect(fatalErr).To(Equal(cli.ErrRecordAndReplay))
+				})
+			})
+		})
+
+		Describe("Network settings", func() {
+			BeforeEach(func() {
+				sut = cli.NewELSCLI(fr, &config, cFile, tp, fs, nil, pipe, pwr, &outS, &errS)
+				args = append(args, "--ca-bundle", "missing.pem")
+			})
+			Context("An API call is made", func() {
+				BeforeEach(func() {
+					args = append(args, "vendors", vendorID, "get")
+				})
+				It("Reports the invalid setting", func() {
+					Expect(fatalErr).NotTo(BeNil())
+					Expect(sut.ExitCode()).To(Equal(cli.ExitUsage))
+				})
+			})
+			Context("A config command is run", func() {
+				BeforeEach(func() {
+					args = append(args, "config", "list")
+				})
+				It("Isn't affected", func() {
+					Expect(fatalErr).To(BeNil())
+				})
+			})
+		})
+
+		Describe("serve-proxy", func() {
+			Context("A non-loopback address is given", func() {
+				BeforeEach(func() {
+					args = append(args, "serve-proxy", "--addr", "0.0.0.0:8080")
+				})
+				It("Refuses to listen", func() {
+					Expect(fatalErr).To(Equal(cli.ErrProxyNotLocal))
+				})
+			})
+		})
+
+		Describe("Formats", func() {
+			listJ := `[
+				{"id":"rs1","name":"A & B","price":{"amount":5,"currency":"GBP"}},
+				{"id":"rs2","name":"C","tags":["x"]}
+			]`
+			BeforeEach(func() {
+				initResponse("Do", 200, listJ)
+			})
+			Context("json-compact", func() {
+				run("--format", "json-compact")
+				It("Writes the body on one line", func() {
+					checkOutputString(`[{"id":"rs1","name":"A & B","price":{"amount":5,"currency":"GBP"}},{"id":"rs2","name":"C","tags":["x"]}]` + "\n")
+				})
+			})
+			Context("yaml", func() {
+				run("--format", "yaml")
+				It("Writes the body as YAML, in order", func() {
+					checkOutputString("- id: rs1\n  name: A & B\n  price:\n    amount: 5\n    currency: GBP\n- id: rs2\n  name: C\n  tags:\n  - x\n")
+				})
+			})
+			Context("jsonl", func() {
+				run("--format", "jsonl")
+				It("Writes each element on its own line", func() {
+					checkOutputString(`{"id":"rs1","name":"A & B","price":{"amount":5,"currency":"GBP"}}` + "\n" + `{"id":"rs2","name":"C","tags":["x"]}` + "\n")
+				})
+			})
+			Context("csv", func() {
+				run("--format", "csv")
+				It("Flattens the elements into columns", func() {
+					checkOutputString("id,name,price.amount,price.currency,tags\nrs1,A & B,5,GBP,\nrs2,C,,,\"[\"\"x\"\"]\"\n")
+				})
+			})
+			Context("csv with columns", func() {
+				run("--format", "csv", "--columns", "name, id")
+				It("Writes only the columns given", func() {
+					checkOutputString("name,id\nA & B,rs1\nC,rs2\n")
+				})
+			})
+			Context("table", func() {
+				run("--format", "table")
+				It("Aligns the columns", func() {
+					checkOutputString(
+						"id   name   price.amount  price.currency  tags\n" +
+							"rs1  A & B  5             GBP             \n" +
+							"rs2  C                                    [\"x\"]\n")
+				})
+			})
+			Context("An invalid format", func() {
+				run("--format", "xml")
+				It("Reports the error", func() {
+					Expect(fatalErr).To(Equal(cli.ErrInvalidFormat))
+					Expect(sut.ExitCode()).To(Equal(cli.ExitUsage))
+				})
+			})
+		})
+
+		Describe("Formats of a list wrapped in an object", func() {
+			BeforeEach(func() {
+				initResponse("Do", 200, `{"count":2,"rulesets":[{"id":"rs1","name":"A"},{"id":"rs2","name":"B"}]}`)
+			})
+			Context("table with columns", func() {
+				run("--format", "table", "--columns", "id,name")
+				It("Writes a row for each element of the list", func() {
+					checkOutputString("id   name\nrs1  A\nrs2  B\n")
+				})
+			})
+			Context("csv", func() {
+				run("--format", "csv")
+				It("Writes a row for each element of the list", func() {
+					checkOutputString("id,name\nrs1,A\nrs2,B\n")
+				})
+			})
+		})
+
+		Describe("Query", func() {
+			listJ := `{"rulesets":[{"id":"rs1","name":"A","active":true},{"id":"rs2","name":"B","active":false}]}`
+			BeforeEach(func() {
+				initResponse("Do", 200, listJ)
+			})
+			Context("A single result", func() {
+				run("--query", ".rulesets[0].name")
+				It("Writes only the result", func() {
+					checkOutputString("\"A\"\n")
+				})
+			})
+			Context("Several results", func() {
+				run("--query", ".rulesets[].id")
+				It("Writes each result in turn", func() {
+					checkOutputString("\"rs1\"\n\"rs2\"\n")
+				})
+			})
+			Context("With jsonl", func() {
+				run("--query", ".rulesets[].id", "--format", "jsonl")
+				It("Writes each result on its own line", func() {
+					checkOutputString("\"rs1\"\n\"rs2\"\n")
+				})
+			})
+			Context("With jsonl and a single result which is an array", func() {
+				run("--query", "[.rulesets[].id]", "--format", "jsonl")
+				It("Writes the array on one line", func() {
+					checkOutputString("[\"rs1\",\"rs2\"]\n")
+				})
+			})
+			Context("With yaml", func() {
+				run("--query", ".rulesets[].name", "--format", "yaml")
+				It("Writes each result as a document", func() {
+					checkOutputString("A\n---\nB\n")
+				})
+			})
+			Context("With csv", func() {
+				run("--query", ".rulesets[] | select(.active) | {id, name}", "--format", "csv")
+				It("Writes the selected objects as rows", func() {
+					checkOutputString("id,name\nrs1,A\n")
+				})
+			})
+			Context("An invalid query", func() {
+				run("--query", ".rulesets[")
+				It("Reports the error", func() {
+					Expect(fatalErr).NotTo(BeNil())
+					Expect(fatalErr.Error()).To(HavePrefix(cli.ErrInvalidQuery.Error()))
+					Expect(sut.ExitCode()).To(Equal(cli.ExitUsage))
+				})
+			})
+			Context("A query which doesn't fit the response", func() {
+				run("--query", ".rulesets.id")
+				It("Reports the error", func() {
+					Expect(fatalErr).NotTo(BeNil())
+					Expect(fatalErr.Error()).To(HavePrefix(cli.ErrQueryFailed.Error()))
+				})
+			})
+		})
+
+		Describe("Content types", func() {
+			// respond sets the response to the call, with the given
+			// Content-Type.
+			respond := func(contentType string, body string) {
+				BeforeEach(func() {
+					rep := em.HTTPResponse(200, body)
+					if contentType != "" {
+						rep.Header.Set("Content-Type", contentType)
+					}
+					ac.AddExpectedCall("Do", em.APICall{ACRep: em.ACRep{Rep: rep}})
+				})
+			}
+			BeforeEach(func() {
+				args = append(args, "do", "GET", "vendors/"+vendorID+"/report")
+			})
+			Context("JSON", func() {
+				respond("application/json; charset=utf-8", `{"a":1}`)
+				It("Writes the JSON indented", func() {
+					checkOutputString("{\n\t\"a\": 1\n}\n")
+				})
+			})
+			Context("Invalid JSON", func() {
+				respond("application/json", `{"a":`)
+				It("Writes the body as it is", func() {
+					Expect(fatalErr).To(BeNil())
+					checkOutputString(`{"a":`)
+				})
+			})
+			Context("CSV", func() {
+				respond("text/csv", "a,b\n1,2\n")
+				It("Writes the body as it is", func() {
+					checkOutputString("a,b\n1,2\n")
+				})
+			})
+			Context("An HTML error page without a Content-Type", func() {
+				respond("", "<html><body>Bad Gateway</body></html>")
+				It("Writes the body as it is", func() {
+					checkOutputString("<html><body>Bad Gateway</body></html>")
+				})
+			})
+			Context("Binary", func() {
+				respond("application/pdf", "%PDF-1.4\x00\x01")
+				Context("Written to a pipe or file", func() {
+					It("Writes the body as it is", func() {
+						checkOutputString("%PDF-1.4\x00\x01")
+					})
+				})
+				Context("Written to a terminal", func() {
+					BeforeEach(func() {
+						tty, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+						Expect(err).To(BeNil())
+						sut = cli.NewELSCLI(fr, &config, cFile, tp, fs, ac, pipe, pwr, tty, &errS)
+					})
+					It("Refuses to write it", func() {
+						Expect(fatalErr).To(Equal(cli.ErrBinaryOutput))
+					})
+				})
+				Context("--out is given", func() {
+					BeforeEach(func() {
+						prof.Output = cli.OutputWhole
+						args = append([]string{"els-cli", "--out", "report.pdf"}, args[1:]...)
+					})
+					It("Writes the body to the file, and the status code to stdout", func() {
+						checkOutputString("200\n")
+						data, err := afero.ReadFile(fs, "report.pdf")
+						Expect(err).To(BeNil())
+						Expect(string(data)).To(Equal("%PDF-1.4\x00\x01"))
+					})
+				})
+			})
+		})
+
+		Describe("Headers", func() {
+			BeforeEach(func() {
+				rep := em.HTTPResponse(201, `{"id":"rs1"}`)
+				rep.Header.Set("Content-Type", "application/json")
+				rep.Header.Set("Location", "/vendors/aVendor/paygRuleSets/rs1")
+				rep.Header.Set("ETag", `"v1"`)
+				rep.Header.Add("X-Ratelimit-Remaining", "9")
+				ac.AddExpectedCall("Do", em.APICall{ACRep: em.ACRep{Rep: rep}})
+				args = append(args, "do", "GET", "vendors/"+vendorID+"/paygRuleSets/rs1")
+			})
+			headersAndBody := "HTTP/1.1 201 Created\n" +
+				"Content-Type: application/json\n" +
+				"Etag: \"v1\"\n" +
+				"Location: /vendors/aVendor/paygRuleSets/rs1\n" +
+				"X-Ratelimit-Remaining: 9\n" +
+				"\n" +
+				"{\n\t\"id\": \"rs1\"\n}\n"
+			Context("--include", func() {
+				BeforeEach(func() {
+					args = append([]string{"els-cli", "--include"}, args[1:]...)
+				})
+				It("Writes the status line and headers before the body", func() {
+					checkOutputString(headersAndBody)
+				})
+			})
+			Context("The withHeaders output", func() {
+				BeforeEach(func() {
+					prof.Output = cli.OutputWithHeaders
+				})
+				It("Writes the status line and headers before the body", func() {
+					checkOutputString(headersAndBody)
+				})
+			})
+			Context("--header-only", func() {
+				BeforeEach(func() {
+					prof.Output = cli.OutputWhole
+					args = append([]string{"els-cli", "--header-only", "etag"}, args[1:]...)
+				})
+				It("Writes only the header's value", func() {
+					checkOutputString("\"v1\"\n")
+					Expect(sut.ExitCode()).To(Equal(cli.ExitOK))
+				})
+			})
+			Context("--header-only names a missing header", func() {
+				BeforeEach(func() {
+					args = append([]string{"els-cli", "--header-only", "Retry-After"}, args[1:]...)
+				})
+				It("Reports the error", func() {
+					Expect(fatalErr).NotTo(BeNil())
+					Expect(fatalErr.Error()).To(Equal(cli.ErrNoSuchHeader.Error() + ": Retry-After"))
+					Expect(outS.String()).To(BeZero())
+				})
+			})
+		})
+
+		Describe("Templates", func() {
+			listJ := `{"rulesets":[{"id":"rs1","status":"active","price":1500},{"id":"rs2","status":"draft","price":2.5}]}`
+			tmpl := `{{range .rulesets}}{{.id}} {{.status}} {{currency "GBP" .price}}{{"\n"}}{{end}}`
+			BeforeEach(func() {
+				initResponse("Do", 200, listJ)
+			})
+			Context("--template", func() {
+				run("--template", tmpl, "--format", "yaml")
+				It("Renders the body with the template", func() {
+					checkOutputString("rs1 active £1,500.00\nrs2 draft £2.50\n")
+				})
+			})
+			Context("--template-file", func() {
+				BeforeEach(func() {
+					afero.WriteFile(fs, "report.tmpl", []byte(tmpl), 0644)
+				})
+				run("--template-file", "report.tmpl")
+				It("Renders the body with the template in the file", func() {
+					checkOutputString("rs1 active £1,500.00\nrs2 draft £2.50\n")
+				})
+			})
+			Context("With --query", func() {
+				run("--query", ".rulesets[1]", "--template", `{{.id}}: {{json .}}`)
+				It("Renders the result of the query", func() {
+					checkOutputString(`rs2: {"id":"rs2","price":2.5,"status":"draft"}`)
+				})
+			})
+			Context("Both --template and --template-file", func() {
+				run("--template", tmpl, "--template-file", "report.tmpl")
+				It("Reports the error", func() {
+					Expect(fatalErr).To(Equal(cli.ErrTemplateAndFile))
+					Expect(sut.ExitCode()).To(Equal(cli.ExitUsage))
+				})
+			})
+			Context("An invalid template", func() {
+				run("--template", "{{.id")
+				It("Reports the error", func() {
+					Expect(fatalErr).NotTo(BeNil())
+					Expect(fatalErr.Error()).To(HavePrefix(cli.ErrInvalidTemplate.Error()))
+					Expect(sut.ExitCode()).To(Equal(cli.ExitUsage))
+				})
+			})
+		})
+
+		Describe("Exit codes", func() {
+			BeforeEach(func() {
+				args = append(args, "vendors", vendorID, "get")
+			})
+			Context("The API responds with 2xx", func() {
+				BeforeEach(func() {
+					initResponse("Do", 200, repJ)
+				})
+				It("Exits with ExitOK", func() {
+					Expect(sut.ExitCode()).To(Equal(cli.ExitOK))
+				})
+			})
+			Context("The API responds with 4xx", func() {
+				BeforeEach(func() {
+					initResponse("Do", 404, repJ)
+				})
+				It("Exits with ExitClientError", func() {
+					Expect(fatalErr).To(BeNil())
+					Expect(sut.ExitCode()).To(Equal(cli.ExitClientError))
+				})
+			})
+			Context("The API responds with 5xx", func() {
+				BeforeEach(func() {
+					initResponse("Do", 500, repJ)
+				})
+				It("Exits with ExitServerError", func() {
+					Expect(sut.ExitCode()).To(Equal(cli.ExitServerError))
+				})
+			})
+			Context("The API can't be reached", func() {
+				BeforeEach(func() {
+					ac.AddExpectedCall("Do", em.APICall{
+						ACRep: em.ACRep{Err: errors.New("no route to host")},
+					})
+				})
+				It("Exits with ExitUnreachable", func() {
+					Expect(fatalErr).To(Equal(cli.ErrAPIUnreachable))
+					Expect(sut.ExitCode()).To(Equal(cli.ExitUnreachable))
+				})
+			})
+			Context("An unknown profile is given", func() {
+				BeforeEach(func() {
+					args = append([]string{"els-cli", "--profile", "unknown"}, args[1:]...)
+				})
+				It("Exits with ExitUsage", func() {
+					Expect(sut.ExitCode()).To(Equal(cli.ExitUsage))
+				})
+			})
+		})
+
+		Describe("Unknown profile", func() {
+			BeforeEach(func() {
+				config.Profiles["staging"] = &cli.Profile{}
+				args = append(args, "--profile", "stagin")
+			})
+			Context("An API command is given", func() {
+				BeforeEach(func() {
+					args = append(args, "do", "GET", "vendors/"+vendorID)
+					initResponse("Do", 200, repJ)
+				})
+				It("Fails without making the call, suggesting the closest profile", func() {
+					Expect(fatalErr.Error()).To(HavePrefix(cli.ErrProfileNotFound.Error()))
+					Expect(fatalErr.Error()).To(ContainSubstring("available profiles: default, staging"))
+					Expect(fatalErr.Error()).To(HaveSuffix("Did you mean 'staging'?"))
+					Expect(outS.String()).To(BeZero())
+				})
+			})
+			Context("The profile is nothing like any profile", func() {
+				BeforeEach(func() {
+					args = append(args[:len(args)-1], "production", "vendors", vendorID, "get")
+				})
+				It("Fails without suggesting a profile", func() {
+					Expect(fatalErr.Error()).To(HavePrefix(cli.ErrProfileNotFound.Error()))
+					Expect(fatalErr.Error()).NotTo(ContainSubstring("Did you mean"))
+				})
+			})
+			Context("A config command is given", func() {
+				BeforeEach(func() {
+					args = append(args, "config", "list")
+				})
+				It("Runs the command", func() {
+					Expect(fatalErr).To(BeNil())
+					checkOutputString("default\nstaging\n")
+				})
+			})
+		})
+
+		Describe("Environment-only profile", func() {
+			BeforeEach(func() {
+				config = cli.Config{}
+				args = append(args, "do", "GET", "vendors/"+vendorID)
+			})
+			Context("The Access Key is given by environment variables", func() {
+				BeforeEach(func() {
+					os.Setenv(cli.EnvAccessKeyID, "envID")
+					os.Setenv(cli.EnvSecretAccessKey, "envSecret")
+					os.Setenv(cli.EnvEmail, email)
+					os.Setenv(cli.EnvOutput, cli.OutputBodyOnly)
+					initResponse("Do", 200, repJ)
+				})
+				AfterEach(func() {
+					os.Unsetenv(cli.EnvAccessKeyID)
+					os.Unsetenv(cli.EnvSecretAccessKey)
+					os.Unsetenv(cli.EnvEmail)
+					os.Unsetenv(cli.EnvOutput)
+				})
+				It("Signs the request with that Access Key", func() {
+					Expect(fatalErr).To(BeNil())
+					k := ac.GetCall(0).ACArgs.Signer.(*cli.Profile).AccessKey
+					Expect(k.ID).To(BeEquivalentTo("envID"))
+					Expect(k.SecretAccessKey).To(BeEquivalentTo("envSecret"))
+					Expect(k.Email).To(Equal(email))
+					checkOutputJSON(repJ)
+				})
+			})
+			Context("No Access Key is given", func() {
+				It("Reports the error without making the call", func() {
+					Expect(fatalErr).To(Equal(cli.ErrNoCredentials))
+				})
+			})
+			Context("An invalid value is given", func() {
+				BeforeEach(func() {
+					os.Setenv(cli.EnvMaxAPITries, "many")
+				})
+				AfterEach(func() {
+					os.Unsetenv(cli.EnvMaxAPITries)
+				})
+				It("Reports the error", func() {
+					Expect(fatalErr.Error()).To(ContainSubstring(cli.EnvMaxAPITries))
+				})
+			})
+		})
+
 		Describe("user", func() {
 			BeforeEach(func() {
 				args = append(args, "users", email)
@@ -231,6 +1145,66 @@ var _ = Describe("els_cliTest Suite", func() {
 							Expect(outS.String()).Should(ContainSubstring(string(accessKey.ID)))
 						})
 					})
+					Context("The key is saved to a new profile", func() {
+						BeforeEach(func() {
+							args = append(args, "--save-profile", "new")
+							ac.AddExpectedCall("CreateAccessKey", em.APICall{
+								ACRep: em.ACRep{
+									StatusCode: 201,
+									AccessKey:  &accessKey,
+								},
+							})
+						})
+						It("Writes the key to the config file without showing the secret", func() {
+							Expect(fatalErr).To(BeNil())
+							Expect(outS.String()).Should(ContainSubstring("saved to profile 'new'"))
+							Expect(outS.String()).ShouldNot(ContainSubstring(string(accessKey.SecretAccessKey)))
+
+							c := readConfig()
+							Expect(c.Profiles["new"].AccessKey.ID).To(Equal(accessKey.ID))
+							Expect(c.Profiles["new"].AccessKey.SecretAccessKey).To(Equal(accessKey.SecretAccessKey))
+							Expect(c.Profiles["new"].AccessKey.Email).To(Equal(accessKey.Email))
+							Expect(c.Profiles["new"].AccessKey.ExpiryDate.Equal(accessKey.ExpiryDate.Truncate(time.Second))).To(BeTrue())
+							Expect(c.Profiles["default"].AccessKey.ID).To(Equal(accessKey.ID))
+						})
+					})
+					Context("The key is saved to an existing profile", func() {
+						BeforeEach(func() {
+							args = append(args, "--save-profile", "default")
+							prof.MaxAPITries = 4
+						})
+						Context("--overwrite is not given", func() {
+							It("Refuses to create the key", func() {
+								Expect(fatalErr).NotTo(BeNil())
+								Expect(errS.String()).Should(ContainSubstring("--overwrite"))
+							})
+						})
+						Context("--overwrite is given", func() {
+							var newKey = els.AccessKey{
+								ID:              "newID",
+								SecretAccessKey: "newSAC",
+								Email:           email,
+							}
+							BeforeEach(func() {
+								args = append(args, "--overwrite", "0")
+								ac.AddExpectedCall("CreateAccessKey", em.APICall{
+									ACRep: em.ACRep{
+										StatusCode: 201,
+										AccessKey:  &newKey,
+									},
+								})
+							})
+							It("Replaces only the key", func() {
+								Expect(fatalErr).To(BeNil())
+								Expect(ac.GetCall(0).ACArgs.ExpiryDays).To(BeZero())
+
+								p := readConfig().Profiles["default"]
+								Expect(p.AccessKey).To(Equal(newKey))
+								Expect(p.MaxAPITries).To(Equal(4))
+								Expect(p.Output).To(Equal(cli.OutputBodyOnly))
+							})
+						})
+					})
 					Context("An invalid password is entered", func() {
 						BeforeEach(func() {
 							ac.AddExpectedCall("CreateAccessKey", em.APICall{
@@ -247,6 +1221,146 @@ var _ = Describe("els_cliTest Suite", func() {
 							Expect(outS.String()).Should(HavePrefix("The email address or password are incorrect"))
 						})
 					})
+					Context("The API can't be reached", func() {
+						BeforeEach(func() {
+							ac.AddExpectedCall("CreateAccessKey", em.APICall{
+								ACRep: em.ACRep{Err: errors.New("no route to host")},
+							})
+						})
+						It("Exits with ExitUnreachable", func() {
+							Expect(fatalErr).To(Equal(cli.ErrAPIUnreachable))
+							Expect(sut.ExitCode()).To(Equal(cli.ExitUnreachable))
+						})
+					})
+				})
+				Describe("rotate", func() {
+					var newKey = els.AccessKey{
+						ID:              "newID",
+						SecretAccessKey: "newSAC",
+						Email:           email,
+						ExpiryDate:      expiry.Truncate(time.Second),
+					}
+					BeforeEach(func() {
+						args = append(args, "rotate")
+						ac.AddExpectedCall("CreateAccessKey", em.APICall{
+							ACRep: em.ACRep{
+								StatusCode: 201,
+								AccessKey:  &newKey,
+							},
+						})
+					})
+					// signedBy returns the ID of the key which signed the i'th
+					// call.
+					signedBy := func(i int) els.AccessKeyID {
+						return ac.GetCall(i).ACArgs.Signer.(*cli.Profile).AccessKey.ID
+					}
+					Context("Every step succeeds", func() {
+						BeforeEach(func() {
+							initResponse("Do", 200, repJ)
+							initResponse("Do", 204, "")
+						})
+						It("Saves the new key then deletes the old key", func() {
+							Expect(fatalErr).To(BeNil())
+							Expect(ac.GetCall(1).ACArgs.Req.Method).To(Equal("GET"))
+							Expect(signedBy(1)).To(Equal(newKey.ID))
+							checkRequestN(2, "DELETE", "/users/"+email+"/accessKeys/"+string(ID))
+							Expect(signedBy(2)).To(Equal(newKey.ID))
+
+							Expect(readConfig().Profiles["default"].AccessKey.ID).To(Equal(newKey.ID))
+						})
+					})
+					Context("Another profile is selected", func() {
+						staging := els.AccessKey{ID: "stagingID", SecretAccessKey: "stagingSAC", Email: email}
+						BeforeEach(func() {
+							config.Profiles["staging"] = &cli.Profile{
+								AccessKey:   staging,
+								MaxAPITries: maxAPITries,
+								Output:      cli.OutputBodyOnly,
+							}
+							args = append([]string{"els-cli", "-p", "staging", "--timeout", "7"}, args[1:]...)
+							initResponse("Do", 200, repJ)
+							initResponse("Do", 204, "")
+						})
+						It("Rotates the key in that profile, with the overrides given", func() {
+							Expect(fatalErr).To(BeNil())
+							Expect(ac.GetCall(1).ACArgs.Signer.(*cli.Profile).APITimeoutSecs).To(Equal(7))
+							checkRequestN(2, "DELETE", "/users/"+email+"/accessKeys/"+string(staging.ID))
+
+							c := readConfig()
+							Expect(c.Profiles["staging"].AccessKey.ID).To(Equal(newKey.ID))
+							Expect(c.Profiles["default"].AccessKey.ID).To(Equal(ID))
+						})
+					})
+					Context("The secret is read from a secretAccessKeyFile", func() {
+						BeforeEach(func() {
+							prof.AccessKey.SecretAccessKey = ""
+							prof.SecretAccessKeyFile = "secret"
+							afero.WriteFile(fs, "secret", []byte(string(SAC)+"\n"), 0600)
+							initResponse("Do", 200, repJ)
+							initResponse("Do", 204, "")
+						})
+						It("Verifies the new key, and writes its secret to the file", func() {
+							Expect(fatalErr).To(BeNil())
+							Expect(ac.GetCall(1).ACArgs.Signer.(*cli.Profile).AccessKey).To(Equal(newKey))
+
+							data, err := afero.ReadFile(fs, "secret")
+							Expect(err).To(BeNil())
+							Expect(string(data)).To(Equal(string(newKey.SecretAccessKey) + "\n"))
+
+							p := readConfig().Profiles["default"]
+							Expect(p.AccessKey.ID).To(Equal(newKey.ID))
+							Expect(p.AccessKey.SecretAccessKey).To(BeZero())
+							Expect(p.SecretAccessKeyFile).To(Equal("secret"))
+						})
+					})
+					Context("The key is given by a credentialProcess", func() {
+						BeforeEach(func() {
+							prof.CredentialProcess = "get-els-key"
+						})
+						It("Refuses to rotate it", func() {
+							Expect(fatalErr).To(Equal(cli.ErrRotateExternalKey))
+							exists, _ := afero.Exists(fs, cFile)
+							Expect(exists).To(BeFalse())
+						})
+					})
+					Context("The key's ID is given by the environment", func() {
+						BeforeEach(func() {
+							os.Setenv(cli.EnvAccessKeyID, string(ID))
+						})
+						AfterEach(func() {
+							os.Unsetenv(cli.EnvAccessKeyID)
+						})
+						It("Refuses to rotate it", func() {
+							Expect(fatalErr).To(Equal(cli.ErrRotateExternalKey))
+							exists, _ := afero.Exists(fs, cFile)
+							Expect(exists).To(BeFalse())
+						})
+					})
+					Context("The new key cannot sign a request", func() {
+						BeforeEach(func() {
+							initResponse("Do", 401, "")
+							initResponse("Do", 204, "")
+						})
+						It("Deletes the new key and leaves the profile unchanged", func() {
+							Expect(fatalErr).To(Equal(cli.ErrKeyVerificationFailed))
+							checkRequestN(2, "DELETE", "/users/"+email+"/accessKeys/"+string(newKey.ID))
+							Expect(signedBy(2)).To(Equal(ID))
+
+							exists, _ := afero.Exists(fs, cFile)
+							Expect(exists).To(BeFalse())
+							Expect(prof.AccessKey.ID).To(Equal(ID))
+						})
+					})
+					Context("The old key cannot be deleted", func() {
+						BeforeEach(func() {
+							initResponse("Do", 200, repJ)
+							initResponse("Do", 404, "")
+						})
+						It("Keeps the new key in the profile", func() {
+							Expect(fatalErr).NotTo(BeNil())
+							Expect(readConfig().Profiles["default"].AccessKey.ID).To(Equal(newKey.ID))
+						})
+					})
 				})
 				Describe("delete", func() {
 					BeforeEach(func() {
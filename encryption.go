@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Errors relating to encrypting the config file.
+var (
+	ErrWrongPassphrase    = errors.New("The config file could not be decrypted - is the passphrase correct?")
+	ErrCorruptEncryption  = errors.New("The encrypted data in the config file is corrupt")
+	ErrNotEncrypted       = errors.New("The config file is not encrypted")
+	ErrEmptyPassphrase    = errors.New("The passphrase must not be empty")
+	ErrPassphraseMismatch = errors.New("The passphrases don't match")
+	ErrInvalidEncryption  = errors.New("Invalid encryption - must be: file|secrets")
+)
+
+// EnvConfigPassphrase names the environment variable which can supply the
+// passphrase of an encrypted config file, instead of prompting for it.
+const EnvConfigPassphrase = "ELSCLI_CONFIG_PASSPHRASE"
+
+// Ways in which the config file can be encrypted.
+const (
+	// EncryptNone means the config file is not encrypted.
+	EncryptNone = ""
+
+	// EncryptFile means the whole config file is encrypted.
+	EncryptFile = "file"
+
+	// EncryptSecrets means only the secretAccessKeys in the config file are
+	// encrypted, so the rest of the file can still be read and edited.
+	EncryptSecrets = "secrets"
+)
+
+const (
+	// sealedPrefix identifies an encrypted value. It is followed by the base64
+	// encoded salt, nonce and ciphertext.
+	sealedPrefix = "els-enc:v1:"
+
+	// KeyEncrypted holds the whole config when it is encrypted with
+	// EncryptFile.
+	KeyEncrypted = "encrypted"
+
+	saltLen = 16
+
+	// scrypt parameters, as recommended for interactive use.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// cipherKeys derives the keys used to encrypt the config from a passphrase.
+// Deriving a key is deliberately slow, so keys are cached by salt.
+type cipherKeys struct {
+	passphrase string
+	keys       map[string]cipher.AEAD
+}
+
+// newCipherKeys returns cipherKeys which derive keys from passphrase.
+func newCipherKeys(passphrase string) *cipherKeys {
+	return &cipherKeys{
+		passphrase: passphrase,
+		keys:       make(map[string]cipher.AEAD),
+	}
+}
+
+// aead returns the cipher for the key derived from the salt.
+func (ck *cipherKeys) aead(salt []byte) (cipher.AEAD, error) {
+	if a, ok := ck.keys[string(salt)]; ok {
+		return a, nil
+	}
+
+	k, err := scrypt.Key([]byte(ck.passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, err
+	}
+
+	ck.keys[string(salt)] = a
+	return a, nil
+}
+
+// seal encrypts plain with the key derived from salt.
+func (ck *cipherKeys) seal(plain []byte, salt []byte) (string, error) {
+	a, err := ck.aead(salt)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, a.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	data := append(append(append([]byte{}, salt...), nonce...), a.Seal(nil, nonce, plain, nil)...)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// open decrypts a value encrypted by seal.
+func (ck *cipherKeys) open(sealed string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil || len(data) < saltLen {
+		return nil, ErrCorruptEncryption
+	}
+
+	a, err := ck.aead(data[:saltLen])
+	if err != nil {
+		return nil, err
+	}
+
+	data = data[saltLen:]
+	if len(data) < a.NonceSize() {
+		return nil, ErrCorruptEncryption
+	}
+
+	plain, err := a.Open(nil, data[:a.NonceSize()], data[a.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return plain, nil
+}
+
+// isSealed reports whether v is a value encrypted by seal.
+func isSealed(v interface{}) bool {
+	s, ok := v.(string)
+	return ok && strings.HasPrefix(s, sealedPrefix)
+}
+
+// ValidEncryption reports whether e identifies one of the ways in which the
+// config file can be encrypted.
+func ValidEncryption(e string) bool {
+	return e == EncryptFile || e == EncryptSecrets
+}
+
+// secretTables calls f with each accessKey table in the TOML document doc
+// which has a secretAccessKey, and that key as named in the table.
+func secretTables(doc map[string]interface{}, f func(t map[string]interface{}, key string) error) error {
+	profiles, _ := lookupKey(doc, "profiles").(map[string]interface{})
+	for _, pt := range profiles {
+		pt, _ := pt.(map[string]interface{})
+		akt, _ := lookupKey(pt, KeyAccessKey).(map[string]interface{})
+		for k := range akt {
+			if strings.EqualFold(k, KeySecretAccessKey) {
+				if err := f(akt, k); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// encryption identifies how the TOML document doc is encrypted.
+func encryption(doc map[string]interface{}) string {
+	if isSealed(doc[KeyEncrypted]) {
+		return EncryptFile
+	}
+
+	enc := EncryptNone
+	secretTables(doc, func(t map[string]interface{}, k string) error {
+		if isSealed(t[k]) {
+			enc = EncryptSecrets
+		}
+		return nil
+	})
+	return enc
+}
+
+// ReadConfig returns the config defined by data, the contents of a config file.
+// If the config file is encrypted, passphrase is called to obtain the
+// passphrase which decrypts it. The config is encrypted in the same way when it
+// is written with Write.
+func ReadConfig(data []byte, passphrase func() (string, error)) (*Config, error) {
+	doc := make(map[string]interface{})
+	if _, err := toml.Decode(string(data), &doc); err != nil {
+		return &Config{}, err
+	}
+
+	enc := encryption(doc)
+	if enc == EncryptNone {
+		return ReadTOML(bytes.NewReader(data))
+	}
+
+	pp, err := passphrase()
+	if err != nil {
+		return &Config{}, err
+	}
+
+	ck := newCipherKeys(pp)
+
+	if enc == EncryptFile {
+		data, err = ck.open(doc[KeyEncrypted].(string))
+	} else {
+		data, err = openSecrets(doc, ck)
+	}
+	if err != nil {
+		return &Config{}, err
+	}
+
+	c, err := ReadTOML(bytes.NewReader(data))
+	c.encryption, c.passphrase = enc, pp
+	return c, err
+}
+
+// openSecrets decrypts each secretAccessKey in the TOML document doc, and
+// returns the document in TOML format.
+func openSecrets(doc map[string]interface{}, ck *cipherKeys) ([]byte, error) {
+	err := secretTables(doc, func(t map[string]interface{}, k string) error {
+		if !isSealed(t[k]) {
+			return nil
+		}
+		plain, err := ck.open(t[k].(string))
+		t[k] = string(plain)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	err = toml.NewEncoder(&b).Encode(doc)
+	return b.Bytes(), err
+}
+
+// Encryption returns how the config is encrypted when written with Write -
+// EncryptNone, EncryptFile or EncryptSecrets.
+func (c *Config) Encryption() string {
+	return c.encryption
+}
+
+// Encrypt sets how the config is encrypted when written with Write, and the
+// passphrase from which the key is derived.
+func (c *Config) Encrypt(enc string, passphrase string) error {
+	if !ValidEncryption(enc) {
+		return ErrInvalidEncryption
+	}
+	if passphrase == "" {
+		return ErrEmptyPassphrase
+	}
+
+	c.encryption, c.passphrase = enc, passphrase
+	return nil
+}
+
+// Decrypt makes Write write the config without encryption.
+func (c *Config) Decrypt() error {
+	if c.encryption == EncryptNone {
+		return ErrNotEncrypted
+	}
+
+	c.encryption, c.passphrase = EncryptNone, ""
+	return nil
+}
+
+// Write writes the config to w as it is stored in the config file - i.e. in
+// TOML format, encrypted as given by Encryption.
+func (c *Config) Write(w io.Writer) error {
+	var b bytes.Buffer
+	if err := c.WriteTOML(&b); err != nil {
+		return err
+	}
+
+	if c.encryption == EncryptNone {
+		_, err := w.Write(b.Bytes())
+		return err
+	}
+
+	salt := make([]byte, saltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	ck := newCipherKeys(c.passphrase)
+
+	doc := make(map[string]interface{})
+
+	if c.encryption == EncryptFile {
+		sealed, err := ck.seal(b.Bytes(), salt)
+		if err != nil {
+			return err
+		}
+		doc[KeyEncrypted] = sealed
+	} else {
+		if _, err := toml.Decode(b.String(), &doc); err != nil {
+			return err
+		}
+		err := secretTables(doc, func(t map[string]interface{}, k string) (err error) {
+			s, _ := t[k].(string)
+			t[k], err = ck.seal([]byte(s), salt)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return toml.NewEncoder(w).Encode(doc)
+}
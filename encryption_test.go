@@ -0,0 +1,110 @@
+package main_test
+
+import (
+	"bytes"
+	"errors"
+
+	cli "github.com/elasticlic/els-cli"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Encryption Test Suite", func() {
+
+	var (
+		err       error
+		sut       *cli.Config
+		written   bytes.Buffer
+		plainTOML = `
+			[profiles.default]
+				maxAPITries = 3
+				[profiles.default.accessKey]
+					id = "elsID1"
+					secretAccessKey = "secretAccessKey1"
+					email = "email1@example.com"
+		`
+
+		// passphrase returns a function which supplies pp as the passphrase.
+		passphrase = func(pp string) func() (string, error) {
+			return func() (string, error) {
+				return pp, nil
+			}
+		}
+	)
+
+	BeforeEach(func() {
+		written = bytes.Buffer{}
+		sut, err = cli.ReadConfig([]byte(plainTOML), func() (string, error) {
+			return "", errors.New("The passphrase should not be needed")
+		})
+		Expect(err).To(BeNil())
+		Expect(sut.Encryption()).To(Equal(cli.EncryptNone))
+	})
+
+	for _, enc := range []string{cli.EncryptFile, cli.EncryptSecrets} {
+		enc := enc
+
+		Context("The config is encrypted with "+enc, func() {
+			BeforeEach(func() {
+				Expect(sut.Encrypt(enc, "aPassphrase")).To(BeNil())
+				Expect(sut.Write(&written)).To(BeNil())
+			})
+			It("doesn't write the secret in plain text", func() {
+				Expect(written.String()).NotTo(ContainSubstring("secretAccessKey1"))
+			})
+			It("can be read with the passphrase", func() {
+				c, err := cli.ReadConfig(written.Bytes(), passphrase("aPassphrase"))
+				Expect(err).To(BeNil())
+				Expect(c.Encryption()).To(Equal(enc))
+				Expect(c.Profiles).To(Equal(sut.Profiles))
+			})
+			It("can't be read with the wrong passphrase", func() {
+				_, err := cli.ReadConfig(written.Bytes(), passphrase("wrong"))
+				Expect(err).To(Equal(cli.ErrWrongPassphrase))
+			})
+		})
+	}
+
+	Context("Only the secrets are encrypted", func() {
+		BeforeEach(func() {
+			sut.Encrypt(cli.EncryptSecrets, "aPassphrase")
+			sut.Write(&written)
+		})
+		It("leaves the other settings readable", func() {
+			Expect(written.String()).To(ContainSubstring("elsID1"))
+			Expect(written.String()).To(ContainSubstring("email1@example.com"))
+		})
+	})
+
+	Context("The encryption is removed", func() {
+		BeforeEach(func() {
+			sut.Encrypt(cli.EncryptFile, "aPassphrase")
+			err = sut.Decrypt()
+			sut.Write(&written)
+		})
+		It("writes the config in plain text", func() {
+			Expect(err).To(BeNil())
+			Expect(written.String()).To(ContainSubstring("secretAccessKey1"))
+		})
+	})
+
+	Context("The config isn't encrypted", func() {
+		It("can't be decrypted", func() {
+			Expect(sut.Decrypt()).To(Equal(cli.ErrNotEncrypted))
+		})
+	})
+
+	Context("Invalid encryption settings are given", func() {
+		It("returns an error", func() {
+			Expect(sut.Encrypt("everything", "aPassphrase")).To(Equal(cli.ErrInvalidEncryption))
+			Expect(sut.Encrypt(cli.EncryptFile, "")).To(Equal(cli.ErrEmptyPassphrase))
+		})
+	})
+
+	Context("The encrypted data is corrupt", func() {
+		It("returns an error", func() {
+			_, err := cli.ReadConfig([]byte(`encrypted = "els-enc:v1:!!"`), passphrase("aPassphrase"))
+			Expect(err).To(Equal(cli.ErrCorruptEncryption))
+		})
+	})
+})
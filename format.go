@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Formats in which response bodies can be written.
+const (
+	// FormatJSON writes JSON indented with tabs. It is the default.
+	FormatJSON = "json"
+
+	// FormatJSONCompact writes JSON on a single line.
+	FormatJSONCompact = "json-compact"
+
+	// FormatYAML writes YAML.
+	FormatYAML = "yaml"
+
+	// FormatTable writes an array of objects as a table with a column for
+	// each property, aligned for reading in a terminal.
+	FormatTable = "table"
+
+	// FormatCSV writes an array of objects as CSV, with a column for each
+	// property.
+	FormatCSV = "csv"
+
+	// FormatJSONL writes each element of an array as compact JSON on its own
+	// line.
+	FormatJSONL = "jsonl"
+)
+
+// ErrInvalidFormat is returned if --format doesn't give a supported format.
+var ErrInvalidFormat = errors.New("Invalid format - must be: json|json-compact|yaml|table|csv|jsonl")
+
+// ValidFormat reports whether f identifies one of the supported formats.
+func ValidFormat(f string) bool {
+	switch f {
+	case FormatJSON, FormatJSONCompact, FormatYAML, FormatTable, FormatCSV, FormatJSONL:
+		return true
+	}
+	return false
+}
+
+// jsonField is a property of a JSON object.
+type jsonField struct {
+	Key   string
+	Value interface{}
+}
+
+// jsonObject is a JSON object whose properties are kept in the order in which
+// they were read, so they are written in the same order.
+type jsonObject []jsonField
+
+// MarshalJSON implements json.Marshaler.
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if err := encodeJSON(&b, f.Key); err != nil {
+			return nil, err
+		}
+		b.WriteByte(':')
+		if err := encodeJSON(&b, f.Value); err != nil {
+			return nil, err
+		}
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// encodeJSON writes v to w as compact JSON, without escaping HTML characters or
+// adding a newline.
+func encodeJSON(w *bytes.Buffer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	w.Truncate(w.Len() - 1)
+	return nil
+}
+
+// compactJSON returns v as compact JSON.
+func compactJSON(v interface{}) (string, error) {
+	var b bytes.Buffer
+	err := encodeJSON(&b, v)
+	return b.String(), err
+}
+
+// decodeJSON decodes the JSON data, keeping the order of the properties of
+// objects (as jsonObjects). Numbers are decoded as json.Numbers, so they are
+// written exactly as they were read.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	v, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("Invalid JSON - unexpected data after the end of the value")
+	}
+
+	return v, nil
+}
+
+// decodeJSONValue decodes the next value from dec.
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t {
+	case json.Delim('{'):
+		o := jsonObject{}
+		for dec.More() {
+			k, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			o = append(o, jsonField{Key: k.(string), Value: v})
+		}
+		_, err := dec.Token()
+		return o, err
+
+	case json.Delim('['):
+		a := []interface{}{}
+		for dec.More() {
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		_, err := dec.Token()
+		return a, err
+	}
+
+	return t, nil
+}
+
+// writeFormatted writes the JSON data to w in format f. For FormatTable and
+// FormatCSV, only the given columns are written, if any are given.
+func writeFormatted(w io.Writer, data []byte, f string, columns []string) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+
+	switch f {
+	case FormatJSON, "":
+		if err := json.Indent(&b, data, "", "\t"); err != nil {
+			return err
+		}
+		b.WriteByte('\n')
+
+	case FormatJSONCompact:
+		if err := json.Compact(&b, data); err != nil {
+			return err
+		}
+		b.WriteByte('\n')
+
+	default:
+		v, err := decodeJSON(data)
+		if err != nil {
+			return err
+		}
+		if err := writeValue(&b, v, f, columns); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// writeResults writes the results of a --query, decoded by decodeJSON, to w in
+// format f. Each result is written in turn, as jq does - e.g. on its own line
+// for FormatJSONL, or as a separate document for FormatYAML. For FormatTable
+// and FormatCSV, each result is a row, except that a result which is an array
+// gives a row for each of its elements.
+func writeResults(w io.Writer, results []interface{}, f string, columns []string) error {
+	switch f {
+	case FormatTable, FormatCSV:
+		var rows []interface{}
+		for _, r := range results {
+			if a, ok := r.([]interface{}); ok {
+				rows = append(rows, a...)
+			} else {
+				rows = append(rows, r)
+			}
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return writeValue(w, rows, f, columns)
+
+	case FormatJSONL:
+		for _, r := range results {
+			s, err := compactJSON(r)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(w, s)
+		}
+		return nil
+	}
+
+	for i, r := range results {
+		if f == FormatYAML && i > 0 {
+			fmt.Fprintln(w, "---")
+		}
+		s, err := compactJSON(r)
+		if err != nil {
+			return err
+		}
+		if err := writeFormatted(w, []byte(s), f, columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeValue writes the value v, decoded by decodeJSON, to w in format f.
+func writeValue(w io.Writer, v interface{}, f string, columns []string) error {
+	switch f {
+	case FormatYAML:
+		data, err := yaml.Marshal(yamlValue(v))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+
+	case FormatJSONL:
+		elems, ok := v.([]interface{})
+		if !ok {
+			elems = []interface{}{v}
+		}
+		for _, e := range elems {
+			s, err := compactJSON(e)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(w, s)
+		}
+		return nil
+
+	case FormatTable, FormatCSV:
+		header, rows, err := flatten(v, columns)
+		if err != nil {
+			return err
+		}
+		if f == FormatCSV {
+			cw := csv.NewWriter(w)
+			cw.Write(header)
+			cw.WriteAll(rows)
+			return cw.Error()
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+		for _, r := range rows {
+			fmt.Fprintln(tw, strings.Join(r, "\t"))
+		}
+		return tw.Flush()
+	}
+
+	return ErrInvalidFormat
+}
+
+// yamlValue returns v, decoded by decodeJSON, as a value which yaml.Marshal
+// writes with the properties of objects in order.
+func yamlValue(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case jsonObject:
+		ms := make(yaml.MapSlice, len(tv))
+		for i, f := range tv {
+			ms[i] = yaml.MapItem{Key: f.Key, Value: yamlValue(f.Value)}
+		}
+		return ms
+	case []interface{}:
+		a := make([]interface{}, len(tv))
+		for i, e := range tv {
+			a[i] = yamlValue(e)
+		}
+		return a
+	}
+	return v
+}
+
+// flatten returns the value v, decoded by decodeJSON, as rows of columns. A
+// list (see listElems) gives a row for each element, and anything else a single
+// row. The properties of objects become columns, with the properties of nested
+// objects named by their path - e.g. "address.city". Arrays within a row are
+// written as compact JSON. Unless columns are given, all the columns found are
+// returned, in the order in which they were found.
+func flatten(v interface{}, columns []string) (header []string, rows [][]string, err error) {
+	elems, ok := listElems(v)
+	if !ok {
+		elems = []interface{}{v}
+	}
+
+	var found []string
+	seen := make(map[string]bool)
+	cells := make([]map[string]string, len(elems))
+
+	for i, e := range elems {
+		cells[i] = make(map[string]string)
+		if err := flattenInto(cells[i], "", e, func(col string) {
+			if !seen[col] {
+				seen[col] = true
+				found = append(found, col)
+			}
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	header = columns
+	if len(header) == 0 {
+		header = found
+	}
+
+	for _, c := range cells {
+		row := make([]string, len(header))
+		for i, col := range header {
+			row[i] = c[col]
+		}
+		rows = append(rows, row)
+	}
+
+	return header, rows, nil
+}
+
+// listElems returns the elements of v, decoded by decodeJSON, if it is a list -
+// either an array, or an object with a single array property which holds
+// objects, as the ELS returns lists - e.g. {"rulesets": [...]}.
+func listElems(v interface{}) ([]interface{}, bool) {
+	if a, ok := v.([]interface{}); ok {
+		return a, true
+	}
+
+	o, ok := v.(jsonObject)
+	if !ok {
+		return nil, false
+	}
+
+	var list []interface{}
+	found := false
+	for _, f := range o {
+		a, ok := f.Value.([]interface{})
+		if !ok {
+			continue
+		}
+		if found {
+			return nil, false
+		}
+		for _, e := range a {
+			if _, ok := e.(jsonObject); !ok {
+				return nil, false
+			}
+		}
+		list, found = a, true
+	}
+
+	return list, found
+}
+
+// flattenInto adds the cells of value v, whose column is named by prefix, to
+// cells. add is called with the name of each column.
+func flattenInto(cells map[string]string, prefix string, v interface{}, add func(col string)) error {
+	if o, ok := v.(jsonObject); ok {
+		for _, f := range o {
+			col := f.Key
+			if prefix != "" {
+				col = prefix + "." + f.Key
+			}
+			if err := flattenInto(cells, col, f.Value, add); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if prefix == "" {
+		prefix = "value"
+	}
+	add(prefix)
+
+	switch tv := v.(type) {
+	case nil:
+		cells[prefix] = ""
+	case string:
+		cells[prefix] = tv
+	case json.Number:
+		cells[prefix] = tv.String()
+	case bool:
+		cells[prefix] = strconv.FormatBool(tv)
+	default:
+		s, err := compactJSON(tv)
+		if err != nil {
+			return err
+		}
+		cells[prefix] = s
+	}
+	return nil
+}
+
+// parseColumns returns the columns given, separated by commas, by --columns.
+func parseColumns(s string) []string {
+	var cols []string
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrNoSuchHeader is returned if the response has no header named by
+// --header-only.
+var ErrNoSuchHeader = errors.New("The response has no such header")
+
+// writeHeaders writes the status line and headers of rep to w, followed by a
+// blank line, as they would appear in an HTTP/1.1 response.
+func writeHeaders(w io.Writer, rep *http.Response) {
+	proto := rep.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	status := rep.Status
+	if status == "" {
+		status = fmt.Sprintf("%d %s", rep.StatusCode, http.StatusText(rep.StatusCode))
+	}
+	fmt.Fprintln(w, proto, status)
+
+	for _, n := range sortedHeaderNames(rep.Header) {
+		for _, v := range rep.Header[n] {
+			fmt.Fprintf(w, "%s: %s\n", n, v)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// writeHeaderOnly writes each value of the header of rep named by
+// --header-only, one per line, and nothing else.
+func (e *ELSCLI) writeHeaderOnly(rep *http.Response) error {
+	vs := rep.Header[http.CanonicalHeaderKey(e.headerOnly)]
+	if len(vs) == 0 {
+		return fmt.Errorf("%s: %s", ErrNoSuchHeader, e.headerOnly)
+	}
+	for _, v := range vs {
+		fmt.Fprintln(e.outputStream, v)
+	}
+	return nil
+}
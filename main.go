@@ -1,12 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/user"
-	"time"
 
-	"github.com/elasticlic/els-api-sdk-go/els"
 	"github.com/elasticlic/go-utils/datetime"
 	"github.com/jawher/mow.cli"
 	"github.com/spf13/afero"
@@ -25,46 +25,52 @@ func configFile() (string, error) {
 
 // readConfig attempts to identify and read the current user's els-cli.config
 // file which is used to configure defaults that will be used if not passed on
-// the commandline with a command.
-func readConfig() (*Config, string) {
+// the commandline with a command. If the file is encrypted, the passphrase is
+// read from the environment or obtained from the user with pw.
+func readConfig(pw Passworder) (*Config, string) {
 
 	cFile, err := configFile()
 	if err != nil {
 		return &Config{}, ""
 	}
 
-	f, err := os.Open(cFile)
+	data, err := ioutil.ReadFile(cFile)
 
+	// No config file is fine - the profile can be given by environment
+	// variables, and the config commands can create one at cFile.
 	if err != nil {
-		return &Config{}, ""
+		return &Config{}, cFile
 	}
 
-	defer f.Close()
-
-	c, err := ReadTOML(f)
-	if err != nil {
-		log.Fatalf("Invalid TOML in config file %s:\n%s", cFile, err)
+	c, err := ReadConfig(data, func() (string, error) {
+		if pp := os.Getenv(EnvConfigPassphrase); pp != "" {
+			return pp, nil
+		}
+		fmt.Fprintf(os.Stderr, "%s is encrypted - enter its passphrase.\n", cFile)
+		return pw.GetPassword()
+	})
+	// A profile which can't be resolved only stops that profile being used, so
+	// that the config commands can still report and fix it:
+	if err != nil && len(c.invalid) == 0 {
+		log.Fatalf("Invalid config file %s:\n%s", cFile, err)
 	}
 
 	return c, cFile
 }
 
 func mainReturnWithCode() int {
-	c, cFile := readConfig()
+	pw := NewHiddenPassworder(os.Stderr)
+	c, cFile := readConfig(pw)
 	ca := cli.App("els-cli", "Make API calls to Elastic Licensing")
 	tp := datetime.NewNowTimeProvider()
-	a := els.NewEDAPICaller(nil, tp, time.Second*5, "")
 	fs := afero.NewOsFs()
 	p := NewCLIPipe()
-	pw := NewHiddenPassworder(os.Stdout)
 
-	ELSCLI := NewELSCLI(ca, c, cFile, tp, fs, a, p, pw, os.Stdout, os.Stderr)
+	ELSCLI := NewELSCLI(ca, c, cFile, tp, fs, nil, p, pw, os.Stdout, os.Stderr)
 
-	if fatalErr := ELSCLI.Run(os.Args); fatalErr != nil {
-		return -1
-	}
+	ELSCLI.Run(os.Args)
 
-	return 0
+	return ELSCLI.ExitCode()
 }
 
 func main() {
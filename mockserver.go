@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elasticlic/els-api-sdk-go/els"
+	"github.com/elasticlic/go-utils/datetime"
+	"github.com/jawher/mow.cli"
+	"github.com/spf13/afero"
+)
+
+// DefaultMockServerAddr is the address on which mock-server listens by default.
+const DefaultMockServerAddr = "127.0.0.1:8081"
+
+// DefaultMockPageSize is the number of results in each page of a paged
+// response from the mock-server.
+const DefaultMockPageSize = 100
+
+// Files in the fixtures directory which don't define API resources.
+const (
+	// MockAccessKeysFile lists the Access Keys with which calls to the
+	// mock-server can be signed.
+	MockAccessKeysFile = "accessKeys.json"
+
+	// MockUsersFile lists the email addresses and passwords of users who can
+	// create Access Keys.
+	MockUsersFile = "users.json"
+)
+
+// Errors relating to the mock-server.
+var (
+	ErrNoFixtures      = errors.New("A fixtures directory must be given with --fixtures")
+	ErrInvalidFixture  = errors.New("Invalid fixture - it must contain JSON")
+	ErrInvalidPageSize = errors.New("Invalid --page-size - it must be at least 1")
+)
+
+// mockAccessKey is an Access Key as it is defined in MockAccessKeysFile, and
+// returned by the mock-server.
+type mockAccessKey struct {
+	ID              string    `json:"accessKeyId"`
+	SecretAccessKey string    `json:"secretAccessKey,omitempty"`
+	Email           string    `json:"email"`
+	ExpiryDate      time.Time `json:"expiryDate"`
+}
+
+// mockUser is a user as defined in MockUsersFile.
+type mockUser struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// MockServer is an http.Handler which imitates the ELS API, for developing and
+// testing scripts without calling the live ELS. Resources are read from JSON
+// fixtures and held in memory, so that PUT, PATCH and DELETE calls change the
+// results of later GETs. Calls must be signed by one of the Access Keys given
+// in the fixtures.
+type MockServer struct {
+	mu        sync.Mutex
+	tp        datetime.TimeProvider
+	pageSize  int
+	docs      map[string]json.RawMessage
+	activated map[string]bool
+	keys      []mockAccessKey
+	passwords map[string]string
+}
+
+// NewMockServer returns a MockServer whose resources are defined by the JSON
+// files in dir. Each file defines the resource whose path is the file's path
+// relative to dir, without the .json extension - e.g. vendors/myVendor.json
+// defines /vendors/myVendor. The Access Keys and users are defined by
+// MockAccessKeysFile and MockUsersFile.
+func NewMockServer(fs afero.Fs, dir string, tp datetime.TimeProvider, pageSize int) (*MockServer, error) {
+	if dir == "" {
+		return nil, ErrNoFixtures
+	}
+	if pageSize < 1 {
+		return nil, ErrInvalidPageSize
+	}
+
+	m := &MockServer{
+		tp:        tp,
+		pageSize:  pageSize,
+		docs:      make(map[string]json.RawMessage),
+		activated: make(map[string]bool),
+		passwords: make(map[string]string),
+	}
+
+	err := afero.Walk(fs, dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".json" {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		data, err := afero.ReadFile(fs, path)
+		if err != nil {
+			return err
+		}
+
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return fmt.Errorf("%s: %s", ErrInvalidFixture, path)
+		}
+
+		switch rel {
+		case MockAccessKeysFile:
+			err = json.Unmarshal(data, &m.keys)
+		case MockUsersFile:
+			var users []mockUser
+			err = json.Unmarshal(data, &users)
+			for _, u := range users {
+				m.passwords[u.Email] = u.Password
+			}
+		default:
+			m.docs["/"+strings.TrimSuffix(filepath.ToSlash(rel), ".json")] = json.RawMessage(data)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", ErrInvalidFixture, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (m *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeMockError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := strings.TrimRight(r.URL.Path, "/")
+	segs := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	// Access Keys are created with a password rather than a signed call:
+	if r.Method == "POST" && len(segs) == 3 && segs[0] == "users" && segs[2] == "accessKeys" {
+		m.createAccessKey(w, segs[1], body)
+		return
+	}
+
+	signer, err := m.authenticate(r, body)
+	if err != nil {
+		writeMockError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	switch {
+	case len(segs) >= 3 && segs[0] == "users" && segs[2] == "accessKeys":
+		m.serveAccessKeys(w, r, signer, segs)
+	case len(segs) == 6 && segs[0] == "vendors" && segs[2] == "customerLicenceEulaInfringements" && r.Method == "GET":
+		m.servePage(w, path, r.URL.Query().Get("cursor"))
+	case len(segs) == 5 && segs[0] == "vendors" && segs[2] == "paygRuleSets" && segs[4] == "activate" && r.Method == "PATCH":
+		m.activate(w, strings.TrimSuffix(path, "/activate"))
+	default:
+		m.serveDoc(w, r.Method, path, body)
+	}
+}
+
+// signedDateHeader is the header in which a signed call gives the time at
+// which it was signed.
+const signedDateHeader = "X-Els-Date"
+
+// maxMockClockSkew is how far the time at which a call was signed may be from
+// the mock-server's time, so that a client whose clock is wrong is refused as
+// it would be by the ELS.
+const maxMockClockSkew = time.Minute * 15
+
+// Reasons for which the mock-server refuses a signed call.
+var (
+	errMockNotSigned = errors.New("The call is not signed by a valid Access Key")
+	errMockClockSkew = errors.New("The call was signed at a time too far from the server's - check the client's clock")
+)
+
+// authenticate returns the Access Key which signed request r, whose body has
+// already been read, or an error if it isn't signed by a valid key. The
+// signature is checked by signing the request again with each key, at the time
+// given by its signedDateHeader.
+func (m *MockServer) authenticate(r *http.Request, body []byte) (*mockAccessKey, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, errMockNotSigned
+	}
+
+	t, ok := parseMockTime(r.Header.Get(signedDateHeader))
+	if !ok {
+		return nil, errMockNotSigned
+	}
+
+	if skew := m.tp.Now().Sub(t); skew > maxMockClockSkew || skew < -maxMockClockSkew {
+		return nil, errMockClockSkew
+	}
+
+	for i := range m.keys {
+		k := &m.keys[i]
+		if !k.ExpiryDate.IsZero() && m.tp.Now().After(k.ExpiryDate) {
+			continue
+		}
+
+		p := &Profile{AccessKey: els.AccessKey{
+			ID:              els.AccessKeyID(k.ID),
+			SecretAccessKey: els.SecretAccessKey(k.SecretAccessKey),
+			Email:           k.Email,
+		}}
+
+		req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for n, v := range r.Header {
+			req.Header[n] = v
+		}
+		req.Header.Del("Authorization")
+
+		if p.Sign(req, t) == nil && req.Header.Get("Authorization") == auth {
+			return k, nil
+		}
+	}
+
+	return nil, errMockNotSigned
+}
+
+// parseMockTime parses the time at which a call was signed.
+func parseMockTime(v string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC1123, time.RFC1123Z, http.TimeFormat, time.RFC3339} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// createAccessKey creates an Access Key for the user with the given email, if
+// the body of the call holds their password.
+func (m *MockServer) createAccessKey(w http.ResponseWriter, email string, body []byte) {
+	req := struct {
+		Password   string `json:"password"`
+		ExpiryDays int    `json:"expiryDays"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeMockError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if pw, ok := m.passwords[email]; !ok || pw != req.Password {
+		writeMockError(w, http.StatusUnauthorized, "The email address or password are incorrect")
+		return
+	}
+
+	k := mockAccessKey{
+		ID:              randomMockString(10, hex.EncodeToString),
+		SecretAccessKey: randomMockString(30, base64.RawURLEncoding.EncodeToString),
+		Email:           email,
+	}
+	if req.ExpiryDays > 0 {
+		k.ExpiryDate = m.tp.Now().AddDate(0, 0, req.ExpiryDays).UTC()
+	}
+	m.keys = append(m.keys, k)
+
+	writeMockJSON(w, http.StatusCreated, k)
+}
+
+// randomMockString returns n random bytes, encoded with enc.
+func randomMockString(n int, enc func([]byte) string) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return enc(b)
+}
+
+// serveAccessKeys lists or deletes the Access Keys of a user. Users can only
+// manage their own keys.
+func (m *MockServer) serveAccessKeys(w http.ResponseWriter, r *http.Request, signer *mockAccessKey, segs []string) {
+	if segs[1] != signer.Email {
+		writeMockError(w, http.StatusForbidden, "Access Keys can only be managed by their owner")
+		return
+	}
+
+	switch {
+	case len(segs) == 3 && r.Method == "GET":
+		keys := []mockAccessKey{}
+		for _, k := range m.keys {
+			if k.Email == segs[1] {
+				k.SecretAccessKey = ""
+				keys = append(keys, k)
+			}
+		}
+		writeMockJSON(w, http.StatusOK, keys)
+
+	case len(segs) == 4 && r.Method == "DELETE":
+		for i, k := range m.keys {
+			if k.Email == segs[1] && k.ID == segs[3] {
+				m.keys = append(m.keys[:i], m.keys[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeMockError(w, http.StatusNotFound, "No such Access Key")
+
+	default:
+		writeMockError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// servePage serves a page of the array of results in the resource at path,
+// beginning at cursor. The response gives the cursor of the next page, if
+// there is one.
+func (m *MockServer) servePage(w http.ResponseWriter, path string, cursor string) {
+	var results []json.RawMessage
+	if doc, ok := m.docs[path]; ok {
+		if err := json.Unmarshal(doc, &results); err != nil {
+			writeMockError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	start := 0
+	if cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(cursor); err != nil || start < 0 || start > len(results) {
+			writeMockError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+	}
+
+	end := start + m.pageSize
+	rep := struct {
+		Cursor                string            `json:"cursor"`
+		CustomerInfringements []json.RawMessage `json:"customerInfringements"`
+	}{}
+	if end < len(results) {
+		rep.Cursor = strconv.Itoa(end)
+	} else {
+		end = len(results)
+	}
+	rep.CustomerInfringements = append([]json.RawMessage{}, results[start:end]...)
+
+	writeMockJSON(w, http.StatusOK, rep)
+}
+
+// activate activates the ruleset at path. An activated ruleset can't be
+// changed.
+func (m *MockServer) activate(w http.ResponseWriter, path string) {
+	doc, ok := m.docs[path]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "No such ruleset")
+		return
+	}
+
+	m.activated[path] = true
+	writeMockRaw(w, http.StatusOK, doc)
+}
+
+// serveDoc gets, puts, patches or deletes the resource at path. Getting a path
+// which isn't a resource, but whose parent is, lists the resources beneath it.
+func (m *MockServer) serveDoc(w http.ResponseWriter, method string, path string, body []byte) {
+	doc, exists := m.docs[path]
+
+	switch method {
+	case "GET":
+		if exists {
+			writeMockRaw(w, http.StatusOK, doc)
+			return
+		}
+		if children, ok := m.children(path); ok {
+			writeMockJSON(w, http.StatusOK, children)
+			return
+		}
+		writeMockError(w, http.StatusNotFound, "Not found")
+
+	case "PUT":
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			writeMockError(w, http.StatusBadRequest, "The body must be JSON")
+			return
+		}
+		if m.activated[path] {
+			writeMockError(w, http.StatusConflict, "An activated ruleset can't be changed")
+			return
+		}
+		m.docs[path] = json.RawMessage(body)
+		status := http.StatusOK
+		if !exists {
+			status = http.StatusCreated
+		}
+		writeMockRaw(w, status, body)
+
+	case "PATCH":
+		if !exists {
+			writeMockError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		merged, err := mergeMockJSON(doc, body)
+		if err != nil {
+			writeMockError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		m.docs[path] = merged
+		writeMockRaw(w, http.StatusOK, merged)
+
+	case "DELETE":
+		if !exists {
+			writeMockError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		delete(m.docs, path)
+		delete(m.activated, path)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeMockError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// children returns the resources directly beneath path, sorted by path. It
+// returns false if there are none, and the parent of path isn't a resource.
+func (m *MockServer) children(path string) ([]json.RawMessage, bool) {
+	var paths []string
+	for p := range m.docs {
+		if strings.HasPrefix(p, path+"/") && !strings.Contains(p[len(path)+1:], "/") {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	children := []json.RawMessage{}
+	for _, p := range paths {
+		children = append(children, m.docs[p])
+	}
+
+	parentExists := false
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		_, parentExists = m.docs[path[:i]]
+	}
+	return children, len(children) > 0 || parentExists
+}
+
+// mergeMockJSON returns the JSON object doc with the properties of the JSON
+// object patch applied to it. An empty patch leaves doc unchanged.
+func mergeMockJSON(doc json.RawMessage, patch []byte) (json.RawMessage, error) {
+	if len(bytes.TrimSpace(patch)) == 0 {
+		return doc, nil
+	}
+
+	var d, p map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return nil, errors.New("Only JSON objects can be patched")
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, errors.New("The body must be a JSON object")
+	}
+
+	for k, v := range p {
+		d[k] = v
+	}
+
+	return json.Marshal(d)
+}
+
+// writeMockJSON writes v as the JSON body of a response with the given status.
+func writeMockJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeMockError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeMockRaw(w, status, data)
+}
+
+// writeMockRaw writes data as the JSON body of a response with the given
+// status.
+func writeMockRaw(w http.ResponseWriter, status int, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// writeMockError writes an error response with the given status and message.
+func writeMockError(w http.ResponseWriter, status int, msg string) {
+	writeMockJSON(w, status, map[string]string{"error": msg})
+}
+
+// serveMockServer runs a MockServer on addr until the els-cli is interrupted.
+func (e *ELSCLI) serveMockServer(addr string, fixtures string, pageSize int) {
+	if err := e.doServeMockServer(addr, fixtures, pageSize); err != nil {
+		e.fatalError(err)
+	}
+}
+
+func (e *ELSCLI) doServeMockServer(addr string, fixtures string, pageSize int) error {
+	m, err := NewMockServer(e.fs, fixtures, e.tp, pageSize)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(e.errorStream, "Serving a mock ELS API from %s (%d resources, %d Access Keys)\n", fixtures, len(m.docs), len(m.keys))
+
+	return e.serve(addr, m)
+}
+
+// mockServerCommands defines the mock-server command.
+func mockServerCommands(c *cli.Cmd) {
+	fixtures := c.String(cli.StringOpt{
+		Name:  "f fixtures",
+		Value: "",
+		Desc:  "The directory containing the JSON fixtures which define the mock API's resources and Access Keys",
+	})
+	addr := c.String(cli.StringOpt{
+		Name:  "a addr",
+		Value: DefaultMockServerAddr,
+		Desc:  "The address and port on which to listen",
+	})
+	pageSize := c.Int(cli.IntOpt{
+		Name:  "page-size",
+		Value: DefaultMockPageSize,
+		Desc:  "The number of results in each page of a paged response",
+	})
+	c.Action = func() {
+		gApp.serveMockServer(*addr, *fixtures, *pageSize)
+	}
+}
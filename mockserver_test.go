@@ -0,0 +1,259 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/elasticlic/els-api-sdk-go/els"
+	cli "github.com/elasticlic/els-cli"
+	"github.com/elasticlic/go-utils/datetime"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/afero"
+)
+
+var _ = Describe("MockServer Test Suite", func() {
+
+	var (
+		fs       afero.Fs
+		tp       datetime.TimeProvider
+		pageSize int
+		sut      *cli.MockServer
+		err      error
+		server   *httptest.Server
+		signer   *cli.Profile
+		skew     time.Duration
+
+		// call makes an API call to the mock-server, signed by signer (if
+		// set) at a time skew from the server's, and returns the status code
+		// and body of the response.
+		call = func(method, path, body string) (int, string) {
+			req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+			Expect(err).To(BeNil())
+			if signer != nil {
+				Expect(signer.Sign(req, tp.Now().Add(skew))).To(Succeed())
+			}
+			rep, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			defer rep.Body.Close()
+			data, _ := ioutil.ReadAll(rep.Body)
+			return rep.StatusCode, string(data)
+		}
+	)
+
+	BeforeEach(func() {
+		fs = afero.NewMemMapFs()
+		tp = datetime.NewNowTimeProvider()
+		pageSize = 2
+		skew = 0
+
+		afero.WriteFile(fs, "fixtures/accessKeys.json", []byte(`[
+			{"accessKeyId":"key1","secretAccessKey":"secret1","email":"a@example.com"}
+		]`), 0644)
+		afero.WriteFile(fs, "fixtures/users.json", []byte(`[
+			{"email":"a@example.com","password":"pw1"}
+		]`), 0644)
+		afero.WriteFile(fs, "fixtures/vendors/v1.json", []byte(`{"name":"Vendor 1"}`), 0644)
+		afero.WriteFile(fs, "fixtures/vendors/v1/paygRuleSets/rs1.json", []byte(`{"id":"rs1"}`), 0644)
+		afero.WriteFile(fs, "fixtures/vendors/v1/paygRuleSets/rs2.json", []byte(`{"id":"rs2"}`), 0644)
+		afero.WriteFile(fs, "fixtures/vendors/v1/customerLicenceEulaInfringements/month/2018/1.json", []byte(`[
+			{"elsCustomerId":"c1"},{"elsCustomerId":"c2"},{"elsCustomerId":"c3"}
+		]`), 0644)
+
+		signer = &cli.Profile{AccessKey: els.AccessKey{ID: "key1", SecretAccessKey: "secret1", Email: "a@example.com"}}
+	})
+
+	JustBeforeEach(func() {
+		sut, err = cli.NewMockServer(fs, "fixtures", tp, pageSize)
+		if err == nil {
+			server = httptest.NewServer(sut)
+		}
+	})
+
+	AfterEach(func() {
+		if server != nil {
+			server.Close()
+			server = nil
+		}
+	})
+
+	Describe("Resources", func() {
+		It("Serves the fixtures", func() {
+			code, body := call("GET", "/vendors/v1", "")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"name":"Vendor 1"}`))
+		})
+		It("Lists the resources beneath a path", func() {
+			code, body := call("GET", "/vendors/v1/paygRuleSets", "")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`[{"id":"rs1"},{"id":"rs2"}]`))
+		})
+		It("Responds with 404 to an unknown resource", func() {
+			code, _ := call("GET", "/vendors/v2", "")
+			Expect(code).To(Equal(http.StatusNotFound))
+		})
+		It("Updates a resource with PUT", func() {
+			code, _ := call("PUT", "/vendors/v1", `{"name":"Renamed"}`)
+			Expect(code).To(Equal(http.StatusOK))
+			_, body := call("GET", "/vendors/v1", "")
+			Expect(body).To(MatchJSON(`{"name":"Renamed"}`))
+		})
+		It("Creates a resource with PUT", func() {
+			code, _ := call("PUT", "/partners/p1", `{"name":"Partner 1"}`)
+			Expect(code).To(Equal(http.StatusCreated))
+			_, body := call("GET", "/partners/p1", "")
+			Expect(body).To(MatchJSON(`{"name":"Partner 1"}`))
+		})
+		It("Merges the properties given with PATCH", func() {
+			code, _ := call("PATCH", "/vendors/v1", `{"url":"https://example.com"}`)
+			Expect(code).To(Equal(http.StatusOK))
+			_, body := call("GET", "/vendors/v1", "")
+			Expect(body).To(MatchJSON(`{"name":"Vendor 1","url":"https://example.com"}`))
+		})
+		It("Deletes a resource", func() {
+			code, _ := call("DELETE", "/vendors/v1/paygRuleSets/rs1", "")
+			Expect(code).To(Equal(http.StatusNoContent))
+			code, _ = call("GET", "/vendors/v1/paygRuleSets/rs1", "")
+			Expect(code).To(Equal(http.StatusNotFound))
+		})
+		It("Doesn't allow an activated ruleset to be changed", func() {
+			code, _ := call("PATCH", "/vendors/v1/paygRuleSets/rs1/activate", "")
+			Expect(code).To(Equal(http.StatusOK))
+			code, _ = call("PUT", "/vendors/v1/paygRuleSets/rs1", `{"id":"rs1"}`)
+			Expect(code).To(Equal(http.StatusConflict))
+		})
+	})
+
+	Describe("Paging", func() {
+		It("Serves results a page at a time", func() {
+			infringements := func(body string) *cli.CustomerEULAInfringementsResponse {
+				r := &cli.CustomerEULAInfringementsResponse{}
+				Expect(json.Unmarshal([]byte(body), r)).To(Succeed())
+				return r
+			}
+			path := "/vendors/v1/customerLicenceEulaInfringements/month/2018/1"
+
+			_, body := call("GET", path, "")
+			page := infringements(body)
+			Expect(page.CustomerInfringements).To(HaveLen(2))
+			Expect(page.Cursor).NotTo(BeEmpty())
+
+			_, body = call("GET", path+"?cursor="+page.Cursor, "")
+			page = infringements(body)
+			Expect(page.CustomerInfringements).To(HaveLen(1))
+			Expect(page.CustomerInfringements[0].ELSCustomerID).To(Equal("c3"))
+			Expect(page.Cursor).To(BeEmpty())
+		})
+	})
+
+	Describe("Signatures", func() {
+		Context("The call isn't signed", func() {
+			BeforeEach(func() {
+				signer = nil
+			})
+			It("Responds with 401", func() {
+				code, _ := call("GET", "/vendors/v1", "")
+				Expect(code).To(Equal(http.StatusUnauthorized))
+			})
+		})
+		Context("The call is signed by an unknown key", func() {
+			BeforeEach(func() {
+				signer.AccessKey.ID = "unknown"
+			})
+			It("Responds with 401", func() {
+				code, _ := call("GET", "/vendors/v1", "")
+				Expect(code).To(Equal(http.StatusUnauthorized))
+			})
+		})
+		Context("The key has expired", func() {
+			BeforeEach(func() {
+				afero.WriteFile(fs, "fixtures/accessKeys.json", []byte(`[
+					{"accessKeyId":"key1","secretAccessKey":"secret1","email":"a@example.com","expiryDate":"2001-01-01T00:00:00Z"}
+				]`), 0644)
+			})
+			It("Responds with 401", func() {
+				code, _ := call("GET", "/vendors/v1", "")
+				Expect(code).To(Equal(http.StatusUnauthorized))
+			})
+		})
+		Context("The client's clock is slightly wrong", func() {
+			BeforeEach(func() {
+				skew = -time.Minute * 5
+			})
+			It("Accepts the call", func() {
+				code, _ := call("GET", "/vendors/v1", "")
+				Expect(code).To(Equal(http.StatusOK))
+			})
+		})
+		Context("The client's clock is badly wrong", func() {
+			BeforeEach(func() {
+				skew = time.Hour
+			})
+			It("Responds with 401", func() {
+				code, body := call("GET", "/vendors/v1", "")
+				Expect(code).To(Equal(http.StatusUnauthorized))
+				Expect(body).To(ContainSubstring("check the client's clock"))
+			})
+		})
+		Context("The signed date is removed", func() {
+			It("Responds with 401", func() {
+				req, err := http.NewRequest("GET", server.URL+"/vendors/v1", nil)
+				Expect(err).To(BeNil())
+				Expect(signer.Sign(req, tp.Now())).To(Succeed())
+				req.Header.Del("X-Els-Date")
+				req.Header.Set("Date", tp.Now().UTC().Format(http.TimeFormat))
+
+				rep, err := http.DefaultClient.Do(req)
+				Expect(err).To(BeNil())
+				rep.Body.Close()
+				Expect(rep.StatusCode).To(Equal(http.StatusUnauthorized))
+			})
+		})
+	})
+
+	Describe("Access Keys", func() {
+		It("Lists the user's keys without their secrets", func() {
+			code, body := call("GET", "/users/a@example.com/accessKeys", "")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring("key1"))
+			Expect(body).NotTo(ContainSubstring("secret1"))
+		})
+		It("Creates a key which can sign calls", func() {
+			signer = nil
+			code, body := call("POST", "/users/a@example.com/accessKeys", `{"password":"pw1","expiryDays":30}`)
+			Expect(code).To(Equal(http.StatusCreated))
+
+			k := els.AccessKey{}
+			Expect(json.Unmarshal([]byte(body), &k)).To(Succeed())
+			Expect(k.ExpiryDate).To(BeTemporally("~", tp.Now().AddDate(0, 0, 30), time.Minute))
+
+			signer = &cli.Profile{AccessKey: k}
+			code, _ = call("GET", "/vendors/v1", "")
+			Expect(code).To(Equal(http.StatusOK))
+		})
+		It("Refuses to create a key with the wrong password", func() {
+			signer = nil
+			code, _ := call("POST", "/users/a@example.com/accessKeys", `{"password":"wrong"}`)
+			Expect(code).To(Equal(http.StatusUnauthorized))
+		})
+		It("Deletes a key", func() {
+			code, _ := call("DELETE", "/users/a@example.com/accessKeys/key1", "")
+			Expect(code).To(Equal(http.StatusNoContent))
+			code, _ = call("GET", "/vendors/v1", "")
+			Expect(code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Describe("Invalid fixtures", func() {
+		BeforeEach(func() {
+			afero.WriteFile(fs, "fixtures/vendors/bad.json", []byte(`{`), 0644)
+		})
+		It("Returns an error", func() {
+			Expect(err.Error()).To(HavePrefix(cli.ErrInvalidFixture.Error()))
+		})
+	})
+})
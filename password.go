@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"os"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -40,7 +41,8 @@ type HiddenPassworder struct {
 }
 
 // NewHiddenPassworder returns a HiddenPassworder which will write prompts to
-// the given writer.
+// the given writer - normally stderr, so that prompts don't end up in output
+// which is redirected.
 func NewHiddenPassworder(outS io.Writer) *HiddenPassworder {
 	return &HiddenPassworder{
 		OutputStream: outS,
@@ -54,7 +56,15 @@ func (p *HiddenPassworder) GetPassword() (string, error) {
 
 	fmt.Fprintln(p.OutputStream, "Enter password: ")
 
-	b, err := terminal.ReadPassword(0)
+	// Read from the controlling terminal if there is one, so the password can
+	// be entered even when stdin is redirected - e.g. to pipe in a request body:
+	fd := int(os.Stdin.Fd())
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		fd = int(tty.Fd())
+	}
+
+	b, err := terminal.ReadPassword(fd)
 	if err != nil {
 		return "", err
 	}
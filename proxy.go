@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/elasticlic/go-utils/datetime"
+	"github.com/jawher/mow.cli"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultProxyAddr is the address on which serve-proxy listens by default.
+const DefaultProxyAddr = "127.0.0.1:8080"
+
+// ErrProxyNotLocal is returned if serve-proxy is asked to listen on an address
+// which other machines could reach: anyone able to connect to the proxy can make
+// calls signed with the profile's Access Key.
+var ErrProxyNotLocal = errors.New("The proxy must listen on a loopback address - e.g. 127.0.0.1:8080")
+
+// Errors with which the proxy refuses requests which may have been sent by a
+// web page, rather than a tool on this machine.
+var (
+	ErrProxyHostNotLocal = errors.New("The proxy only accepts requests addressed to localhost or a loopback address")
+	ErrProxyOrigin       = errors.New("The proxy doesn't accept requests from web pages unless their origin is allowed with --allow-origin")
+)
+
+// Proxy is an http.Handler which signs the requests it receives with the Access
+// Key of a profile and forwards them to the profile's ELS API, so that tools
+// which can't sign requests can call the API.
+//
+// As any web page open in a browser on this machine can send requests to the
+// proxy, it refuses requests which aren't addressed to a loopback host (so a
+// page can't use DNS rebinding to read the responses), and requests which carry
+// an Origin header, unless the origin is allowed (see AllowOrigins).
+type Proxy struct {
+	profile *Profile
+	tp      datetime.TimeProvider
+	root    *url.URL
+	rp      *httputil.ReverseProxy
+	origins map[string]bool
+}
+
+// NewProxy returns a Proxy which signs requests with the Access Key of profile
+// p and forwards them to its APIURL with transport t, or http.DefaultTransport
+// if t is nil. The path of each request is relative to the API root - e.g.
+// "/vendors/myVendor".
+func NewProxy(p *Profile, tp datetime.TimeProvider, t http.RoundTripper) (*Proxy, error) {
+	if t == nil {
+		t = http.DefaultTransport
+	}
+
+	if p.APIURL == "" {
+		return nil, ErrAPIRootUnknown
+	}
+
+	root, err := url.Parse(p.APIURL)
+	if err != nil {
+		return nil, err
+	}
+
+	px := &Proxy{
+		profile: p,
+		tp:      tp,
+		root:    root,
+		rp:      httputil.NewSingleHostReverseProxy(root),
+		origins: make(map[string]bool),
+	}
+
+	direct := px.rp.Director
+	px.rp.Director = func(r *http.Request) {
+		direct(r)
+		r.Host = root.Host
+	}
+	px.rp.Transport = &signingTransport{px: px, base: t}
+	px.rp.FlushInterval = time.Millisecond * 100
+	px.rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.WithFields(log.Fields{"Time": tp.Now(), "method": r.Method, "url": r.URL, "err": err}).Debug("Proxy could not access API")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+
+	return px, nil
+}
+
+// AllowOrigins allows requests from web pages with the given origins - e.g.
+// "http://localhost:3000".
+func (px *Proxy) AllowOrigins(origins ...string) {
+	for _, o := range origins {
+		px.origins[strings.TrimSuffix(o, "/")] = true
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (px *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch {
+	case !isLoopbackHost(r.Host):
+		err = ErrProxyHostNotLocal
+	case r.Header.Get("Origin") != "" && !px.origins[r.Header.Get("Origin")]:
+		err = ErrProxyOrigin
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{"Time": px.tp.Now(), "method": r.Method, "url": r.URL, "host": r.Host, "origin": r.Header.Get("Origin")}).Debug("Proxy refused request")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	px.rp.ServeHTTP(w, r)
+}
+
+// signingTransport signs each request before sending it with base.
+type signingTransport struct {
+	px   *Proxy
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *signingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	out := new(http.Request)
+	*out = *r
+	out.Header = make(http.Header, len(r.Header))
+	for n, v := range r.Header {
+		out.Header[n] = v
+	}
+
+	// The signer may read the body, so it is buffered to be sent afterwards:
+	if r.Body != nil {
+		data, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = ioutil.NopCloser(bytes.NewReader(data))
+		out.ContentLength = int64(len(data))
+		out.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+
+	// Never forward credentials supplied by the client:
+	out.Header.Del("Authorization")
+
+	if err := t.px.profile.Sign(out, t.px.tp.Now()); err != nil {
+		return nil, err
+	}
+
+	return t.base.RoundTrip(out)
+}
+
+// isLoopback reports whether the host of addr can only be reached from this
+// machine.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return isLoopbackName(host)
+}
+
+// isLoopbackHost reports whether the Host header of a request, with or without
+// a port, names this machine.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return isLoopbackName(strings.Trim(host, "[]"))
+}
+
+// isLoopbackName reports whether host is localhost or a loopback IP address.
+func isLoopbackName(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveProxy runs a Proxy for the selected profile on addr until the els-cli is
+// interrupted.
+func (e *ELSCLI) serveProxy(addr string, origins []string) {
+	if err := e.doServeProxy(addr, origins); err != nil {
+		e.fatalError(err)
+	}
+}
+
+func (e *ELSCLI) doServeProxy(addr string, origins []string) error {
+	if !isLoopback(addr) {
+		return ErrProxyNotLocal
+	}
+
+	if err := e.profile.LoadCredentials(e.fs, e.errorStream); err != nil {
+		return err
+	}
+
+	if !e.profile.HasAccessKey() {
+		return ErrNoCredentials
+	}
+
+	t, err := e.profile.Transport(e.fs)
+	if err != nil {
+		return err
+	}
+
+	// Forward calls to the same API root as other commands would call:
+	p := *e.profile
+	if p.APIURL, err = e.apiRoot(); err != nil {
+		return err
+	}
+
+	px, err := NewProxy(&p, e.tp, t)
+	if err != nil {
+		return err
+	}
+	px.AllowOrigins(origins...)
+
+	fmt.Fprintf(e.errorStream, "Signing calls as %s and forwarding them to %s\n", e.profile.AccessKey.Email, px.root)
+
+	return e.serve(addr, px)
+}
+
+// serve serves h on addr until the els-cli is interrupted.
+func (e *ELSCLI) serve(addr string, h http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: h}
+
+	go func() {
+		<-e.ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	fmt.Fprintf(e.errorStream, "Listening on http://%s - press Ctrl-C to stop\n", l.Addr())
+
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// proxyCommands defines the serve-proxy command.
+func proxyCommands(c *cli.Cmd) {
+	addr := c.String(cli.StringOpt{
+		Name:  "a addr",
+		Value: DefaultProxyAddr,
+		Desc:  "The loopback address and port on which to listen",
+	})
+	origins := c.Strings(cli.StringsOpt{
+		Name:  "allow-origin",
+		Value: nil,
+		Desc:  "The origin of a web page allowed to call the proxy - e.g. http://localhost:3000. May be repeated",
+	})
+	c.Action = func() {
+		gApp.serveProxy(*addr, *origins)
+	}
+}
@@ -0,0 +1,136 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/elasticlic/els-api-sdk-go/els"
+	cli "github.com/elasticlic/els-cli"
+	"github.com/elasticlic/go-utils/datetime"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Proxy Test Suite", func() {
+
+	var (
+		api      *httptest.Server
+		px       *cli.Proxy
+		proxy    *httptest.Server
+		received *http.Request
+		body     string
+		rep      *http.Response
+		repBody  string
+		err      error
+		req      *http.Request
+	)
+
+	BeforeEach(func() {
+		received = nil
+		body = ""
+		api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			received, body = r, string(b)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"vendorId":"aVendor"}`))
+		}))
+
+		p := &cli.Profile{
+			APIURL: api.URL + "/1.0",
+			AccessKey: els.AccessKey{
+				ID:              "anID",
+				SecretAccessKey: "aSecret",
+			},
+		}
+		px, err = cli.NewProxy(p, datetime.NewNowTimeProvider(), nil)
+		Expect(err).To(BeNil())
+		proxy = httptest.NewServer(px)
+
+		req, _ = http.NewRequest("PUT", proxy.URL+"/vendors/aVendor", strings.NewReader(`{"name":"A Vendor"}`))
+		req.Header.Set("Authorization", "Bearer someoneElse")
+	})
+
+	JustBeforeEach(func() {
+		rep, err = http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		b, _ := ioutil.ReadAll(rep.Body)
+		rep.Body.Close()
+		repBody = string(b)
+	})
+
+	AfterEach(func() {
+		proxy.Close()
+		api.Close()
+	})
+
+	It("Forwards the request to the API root", func() {
+		Expect(received.Method).To(Equal("PUT"))
+		Expect(received.URL.Path).To(Equal("/1.0/vendors/aVendor"))
+		Expect(body).To(Equal(`{"name":"A Vendor"}`))
+	})
+	It("Signs the request with the profile's Access Key", func() {
+		Expect(received.Header.Get("Authorization")).To(HavePrefix("ELS anID"))
+	})
+	It("Returns the API's response", func() {
+		Expect(rep.StatusCode).To(Equal(http.StatusCreated))
+		Expect(repBody).To(Equal(`{"vendorId":"aVendor"}`))
+	})
+
+	Context("The request is addressed to another host, as after DNS rebinding", func() {
+		BeforeEach(func() {
+			req.Host = "attacker.example.com:8080"
+		})
+		It("Refuses the request without signing it", func() {
+			Expect(rep.StatusCode).To(Equal(http.StatusForbidden))
+			Expect(repBody).To(ContainSubstring(cli.ErrProxyHostNotLocal.Error()))
+			Expect(received).To(BeNil())
+		})
+	})
+
+	Context("The request is addressed to localhost", func() {
+		BeforeEach(func() {
+			req.Host = "localhost:8080"
+		})
+		It("Forwards the request", func() {
+			Expect(rep.StatusCode).To(Equal(http.StatusCreated))
+		})
+	})
+
+	Context("The request comes from a web page", func() {
+		BeforeEach(func() {
+			req.Header.Set("Origin", "https://attacker.example.com")
+		})
+		It("Refuses the request without signing it", func() {
+			Expect(rep.StatusCode).To(Equal(http.StatusForbidden))
+			Expect(repBody).To(ContainSubstring(cli.ErrProxyOrigin.Error()))
+			Expect(received).To(BeNil())
+		})
+	})
+
+	Context("The request comes from an allowed web page", func() {
+		BeforeEach(func() {
+			px.AllowOrigins("http://localhost:3000/")
+			req.Header.Set("Origin", "http://localhost:3000")
+		})
+		It("Forwards the request", func() {
+			Expect(rep.StatusCode).To(Equal(http.StatusCreated))
+			Expect(received.Header.Get("Authorization")).To(HavePrefix("ELS anID"))
+		})
+	})
+
+	Context("The API can't be reached", func() {
+		BeforeEach(func() {
+			api.Close()
+		})
+		It("Responds with Bad Gateway", func() {
+			Expect(rep.StatusCode).To(Equal(http.StatusBadGateway))
+		})
+	})
+
+	It("Needs the root URL of the API", func() {
+		_, err := cli.NewProxy(&cli.Profile{}, datetime.NewNowTimeProvider(), nil)
+		Expect(err).To(Equal(cli.ErrAPIRootUnknown))
+	})
+})
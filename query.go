@@ -0,0 +1,898 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Errors relating to --query.
+var (
+	ErrInvalidQuery = errors.New("Invalid query")
+	ErrQueryFailed  = errors.New("The query could not be applied to the response")
+)
+
+// Query is a filter, written in a subset of the jq language, which selects and
+// reshapes parts of a JSON document. It supports:
+//
+//	.                 the input
+//	.foo, ."foo"      a property of an object (null if it's missing)
+//	.[2], .[-1]       an element of an array
+//	.[]               each element of an array, or value of an object
+//	.[1:3]            a slice of an array or string
+//	a | b             b applied to each result of a
+//	a, b              the results of a, then the results of b
+//	[a]               an array of the results of a
+//	{id, n: .name}    an object of the results given
+//	a == b, !=, <, <=, >, >=, and, or
+//	select(a)         the input, if a is true
+//	length, keys, not
+//	a?                the results of a, ignoring any errors
+//	"str", 1, true, false, null
+type Query struct {
+	f filter
+}
+
+// filter produces results from an input value. Values are as decoded by
+// decodeJSON.
+type filter func(v interface{}) ([]interface{}, error)
+
+// ParseQuery parses the query src.
+func ParseQuery(src string) (*Query, error) {
+	toks, err := lexQuery(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{toks: toks}
+	f, err := p.parsePipe()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+
+	return &Query{f: f}, nil
+}
+
+// Run applies the query to the JSON data, and returns its results, as decoded
+// by decodeJSON. As with jq, a query produces a stream of any number of
+// results, each of which is written separately (see writeResults).
+func (q *Query) Run(data []byte) ([]interface{}, error) {
+	v, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := q.f(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrQueryFailed, err)
+	}
+	return results, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokDot
+	tokField
+	tokIdent
+	tokString
+	tokNumber
+	tokPunct
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lexQuery splits the query src into tokens.
+func lexQuery(src string) ([]token, error) {
+	var toks []token
+
+	isIdent := func(r rune, first bool) bool {
+		return r == '_' || unicode.IsLetter(r) || (!first && unicode.IsDigit(r))
+	}
+
+	// ident returns the identifier at the start of s.
+	ident := func(s string) string {
+		for i, r := range s {
+			if !isIdent(r, i == 0) {
+				return s[:i]
+			}
+		}
+		return s
+	}
+
+	for i := 0; i < len(src); {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		rest := src[i:]
+
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			continue
+
+		case r == '.':
+			if id := ident(rest[1:]); id != "" {
+				toks = append(toks, token{tokField, id, i})
+				i += 1 + len(id)
+			} else {
+				toks = append(toks, token{tokDot, ".", i})
+				i++
+			}
+			continue
+
+		case isIdent(r, true):
+			id := ident(rest)
+			toks = append(toks, token{tokIdent, id, i})
+			i += len(id)
+			continue
+
+		case r == '"':
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				return nil, fmt.Errorf("%s: unterminated string at position %d", ErrInvalidQuery, i)
+			}
+			var s string
+			if err := json.Unmarshal([]byte(rest[:end+1]), &s); err != nil {
+				return nil, fmt.Errorf("%s: invalid string at position %d", ErrInvalidQuery, i)
+			}
+			toks = append(toks, token{tokString, s, i})
+			i += end + 1
+			continue
+
+		case unicode.IsDigit(r) || (r == '-' && len(rest) > 1 && rest[1] >= '0' && rest[1] <= '9'):
+			end := 1
+			for end < len(rest) && strings.ContainsRune("0123456789.eE+-", rune(rest[end])) {
+				end++
+			}
+			if _, err := strconv.ParseFloat(rest[:end], 64); err != nil {
+				return nil, fmt.Errorf("%s: invalid number at position %d", ErrInvalidQuery, i)
+			}
+			toks = append(toks, token{tokNumber, rest[:end], i})
+			i += end
+			continue
+		}
+
+		if len(rest) > 1 && (rest[:2] == "==" || rest[:2] == "!=" || rest[:2] == "<=" || rest[:2] == ">=") {
+			toks = append(toks, token{tokOp, rest[:2], i})
+			i += 2
+			continue
+		}
+
+		switch r {
+		case '<', '>':
+			toks = append(toks, token{tokOp, string(r), i})
+		case '[', ']', '{', '}', '(', ')', '|', ',', ':', '?':
+			toks = append(toks, token{tokPunct, string(r), i})
+		default:
+			return nil, fmt.Errorf("%s: unexpected %q at position %d", ErrInvalidQuery, r, i)
+		}
+		i += size
+	}
+
+	return append(toks, token{tokEOF, "end of query", len(src)}), nil
+}
+
+// queryParser parses a query by recursive descent. In order of increasing
+// precedence, the grammar is: pipe, comma, or, and, comparison, postfix, then
+// primary.
+type queryParser struct {
+	toks []token
+	i    int
+}
+
+func (p *queryParser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *queryParser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// accept consumes the next token if it is of kind k with the given text.
+func (p *queryParser) accept(k tokenKind, text string) bool {
+	if t := p.peek(); t.kind == k && t.text == text {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expect(k tokenKind, text string) error {
+	if !p.accept(k, text) {
+		t := p.peek()
+		return p.errorf(t, "expected %q but found %q", text, t.text)
+	}
+	return nil
+}
+
+func (p *queryParser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s at position %d", ErrInvalidQuery, fmt.Sprintf(format, args...), t.pos)
+}
+
+func (p *queryParser) parsePipe() (filter, error) {
+	l, err := p.parseComma()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokPunct, "|") {
+		r, err := p.parseComma()
+		if err != nil {
+			return nil, err
+		}
+		l = pipeFilter(l, r)
+	}
+	return l, nil
+}
+
+func (p *queryParser) parseComma() (filter, error) {
+	l, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokPunct, ",") {
+		r, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		l = commaFilter(l, r)
+	}
+	return l, nil
+}
+
+func (p *queryParser) parseOr() (filter, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokIdent, "or") {
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryFilter(l, r, func(a, b interface{}) (interface{}, error) {
+			return truthy(a) || truthy(b), nil
+		})
+	}
+	return l, nil
+}
+
+func (p *queryParser) parseAnd() (filter, error) {
+	l, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokIdent, "and") {
+		r, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryFilter(l, r, func(a, b interface{}) (interface{}, error) {
+			return truthy(a) && truthy(b), nil
+		})
+	}
+	return l, nil
+}
+
+func (p *queryParser) parseComparison() (filter, error) {
+	l, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind != tokOp {
+		return l, nil
+	}
+	p.next()
+
+	r, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+
+	return binaryFilter(l, r, func(a, b interface{}) (interface{}, error) {
+		c := compareValues(a, b)
+		switch t.text {
+		case "==":
+			return c == 0, nil
+		case "!=":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	}), nil
+}
+
+func (p *queryParser) parsePostfix() (filter, error) {
+	f, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokField:
+			p.next()
+			f = pipeFilter(f, fieldFilter(t.text))
+		case t.kind == tokDot && p.toks[p.i+1].kind == tokString:
+			p.next()
+			f = pipeFilter(f, fieldFilter(p.next().text))
+		case p.accept(tokPunct, "["):
+			b, err := p.parseBracket()
+			if err != nil {
+				return nil, err
+			}
+			f = pipeFilter(f, b)
+		case p.accept(tokPunct, "?"):
+			f = tryFilter(f)
+		default:
+			return f, nil
+		}
+	}
+}
+
+func (p *queryParser) parsePrimary() (filter, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokDot:
+		if p.peek().kind == tokString {
+			return fieldFilter(p.next().text), nil
+		}
+		if p.accept(tokPunct, "[") {
+			return p.parseBracket()
+		}
+		return identityFilter, nil
+
+	case tokField:
+		return fieldFilter(t.text), nil
+
+	case tokString:
+		return literalFilter(t.text), nil
+
+	case tokNumber:
+		return literalFilter(json.Number(t.text)), nil
+
+	case tokIdent:
+		return p.parseFunction(t)
+
+	case tokPunct:
+		switch t.text {
+		case "(":
+			f, err := p.parsePipe()
+			if err != nil {
+				return nil, err
+			}
+			return f, p.expect(tokPunct, ")")
+
+		case "[":
+			if p.accept(tokPunct, "]") {
+				return literalFilter([]interface{}{}), nil
+			}
+			f, err := p.parsePipe()
+			if err != nil {
+				return nil, err
+			}
+			return collectFilter(f), p.expect(tokPunct, "]")
+
+		case "{":
+			return p.parseObject()
+		}
+	}
+
+	return nil, p.errorf(t, "unexpected %q", t.text)
+}
+
+// parseFunction parses the keyword or function identified by t.
+func (p *queryParser) parseFunction(t token) (filter, error) {
+	switch t.text {
+	case "true":
+		return literalFilter(true), nil
+	case "false":
+		return literalFilter(false), nil
+	case "null":
+		return literalFilter(nil), nil
+	case "length":
+		return lengthFilter, nil
+	case "keys":
+		return keysFilter, nil
+	case "not":
+		return func(v interface{}) ([]interface{}, error) {
+			return []interface{}{!truthy(v)}, nil
+		}, nil
+	case "select":
+		if err := p.expect(tokPunct, "("); err != nil {
+			return nil, err
+		}
+		cond, err := p.parsePipe()
+		if err != nil {
+			return nil, err
+		}
+		return selectFilter(cond), p.expect(tokPunct, ")")
+	}
+
+	return nil, p.errorf(t, "unknown function %q", t.text)
+}
+
+// parseBracket parses what follows "[" in a path: "]", an index or a slice.
+func (p *queryParser) parseBracket() (filter, error) {
+	if p.accept(tokPunct, "]") {
+		return iterateFilter, nil
+	}
+
+	var from, to filter
+	var err error
+
+	if !p.accept(tokPunct, ":") {
+		if from, err = p.parsePipe(); err != nil {
+			return nil, err
+		}
+		if p.accept(tokPunct, "]") {
+			return indexFilter(from), nil
+		}
+		if err := p.expect(tokPunct, ":"); err != nil {
+			return nil, err
+		}
+	}
+
+	if !p.accept(tokPunct, "]") {
+		if to, err = p.parsePipe(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokPunct, "]"); err != nil {
+			return nil, err
+		}
+	}
+
+	return sliceFilter(from, to), nil
+}
+
+// parseObject parses an object construction, following "{".
+func (p *queryParser) parseObject() (filter, error) {
+	type entry struct {
+		key string
+		val filter
+	}
+	var entries []entry
+
+	for !p.accept(tokPunct, "}") {
+		if len(entries) > 0 {
+			if err := p.expect(tokPunct, ","); err != nil {
+				return nil, err
+			}
+		}
+
+		t := p.next()
+		if t.kind != tokIdent && t.kind != tokString {
+			return nil, p.errorf(t, "expected a property name but found %q", t.text)
+		}
+
+		e := entry{key: t.text, val: fieldFilter(t.text)}
+		if p.accept(tokPunct, ":") {
+			f, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			e.val = f
+		}
+		entries = append(entries, e)
+	}
+
+	return func(v interface{}) ([]interface{}, error) {
+		objs := []jsonObject{{}}
+		for _, e := range entries {
+			vals, err := e.val(v)
+			if err != nil {
+				return nil, err
+			}
+			var next []jsonObject
+			for _, o := range objs {
+				for _, val := range vals {
+					no := append(append(jsonObject{}, o...), jsonField{Key: e.key, Value: val})
+					next = append(next, no)
+				}
+			}
+			objs = next
+		}
+
+		results := make([]interface{}, len(objs))
+		for i, o := range objs {
+			results[i] = o
+		}
+		return results, nil
+	}, nil
+}
+
+func identityFilter(v interface{}) ([]interface{}, error) {
+	return []interface{}{v}, nil
+}
+
+func literalFilter(lit interface{}) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		return []interface{}{lit}, nil
+	}
+}
+
+func pipeFilter(l, r filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		lvs, err := l(v)
+		if err != nil {
+			return nil, err
+		}
+		var results []interface{}
+		for _, lv := range lvs {
+			rvs, err := r(lv)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, rvs...)
+		}
+		return results, nil
+	}
+}
+
+func commaFilter(l, r filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		lvs, err := l(v)
+		if err != nil {
+			return nil, err
+		}
+		rvs, err := r(v)
+		if err != nil {
+			return nil, err
+		}
+		return append(lvs, rvs...), nil
+	}
+}
+
+// binaryFilter returns a filter which applies op to each combination of the
+// results of l and r.
+func binaryFilter(l, r filter, op func(a, b interface{}) (interface{}, error)) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		lvs, err := l(v)
+		if err != nil {
+			return nil, err
+		}
+		rvs, err := r(v)
+		if err != nil {
+			return nil, err
+		}
+		var results []interface{}
+		for _, lv := range lvs {
+			for _, rv := range rvs {
+				res, err := op(lv, rv)
+				if err != nil {
+					return nil, err
+				}
+				results = append(results, res)
+			}
+		}
+		return results, nil
+	}
+}
+
+func collectFilter(f filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		vs, err := f(v)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{append([]interface{}{}, vs...)}, nil
+	}
+}
+
+func tryFilter(f filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		vs, err := f(v)
+		if err != nil {
+			return nil, nil
+		}
+		return vs, nil
+	}
+}
+
+func selectFilter(cond filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		cs, err := cond(v)
+		if err != nil {
+			return nil, err
+		}
+		var results []interface{}
+		for _, c := range cs {
+			if truthy(c) {
+				results = append(results, v)
+			}
+		}
+		return results, nil
+	}
+}
+
+func fieldFilter(name string) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		fv, err := field(v, name)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{fv}, nil
+	}
+}
+
+// field returns the property of v with the given name, or nil if it has none.
+func field(v interface{}, name string) (interface{}, error) {
+	switch tv := v.(type) {
+	case nil:
+		return nil, nil
+	case jsonObject:
+		var fv interface{}
+		for _, f := range tv {
+			if f.Key == name {
+				fv = f.Value
+			}
+		}
+		return fv, nil
+	}
+	return nil, fmt.Errorf("cannot get property %q of %s", name, typeName(v))
+}
+
+func indexFilter(idx filter) filter {
+	return func(v interface{}) ([]interface{}, error) {
+		ks, err := idx(v)
+		if err != nil {
+			return nil, err
+		}
+		var results []interface{}
+		for _, k := range ks {
+			var r interface{}
+			switch tk := k.(type) {
+			case string:
+				if r, err = field(v, tk); err != nil {
+					return nil, err
+				}
+			case json.Number:
+				if r, err = element(v, tk); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("cannot index with %s", typeName(k))
+			}
+			results = append(results, r)
+		}
+		return results, nil
+	}
+}
+
+// element returns the element of the array v at index n, counting from the end
+// if n is negative, or nil if there is none.
+func element(v interface{}, n json.Number) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot index %s with a number", typeName(v))
+	}
+	i, err := n.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("invalid index %s", n)
+	}
+	if i < 0 {
+		i += int64(len(a))
+	}
+	if i < 0 || i >= int64(len(a)) {
+		return nil, nil
+	}
+	return a[i], nil
+}
+
+func sliceFilter(from, to filter) filter {
+	// bound returns the single result of f applied to v as an index into a
+	// sequence of length n, or def if f is nil.
+	bound := func(f filter, v interface{}, n int, def int) (int, error) {
+		if f == nil {
+			return def, nil
+		}
+		bs, err := f(v)
+		if err != nil {
+			return 0, err
+		}
+		var num json.Number
+		if len(bs) == 1 {
+			num, _ = bs[0].(json.Number)
+		}
+		if num == "" {
+			return 0, errors.New("slice bounds must be numbers")
+		}
+		i, err := num.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("invalid slice bound %s", num)
+		}
+		if i < 0 {
+			i += int64(n)
+		}
+		if i < 0 {
+			i = 0
+		}
+		if i > int64(n) {
+			i = int64(n)
+		}
+		return int(i), nil
+	}
+
+	return func(v interface{}) ([]interface{}, error) {
+		var n int
+		switch tv := v.(type) {
+		case nil:
+			return []interface{}{nil}, nil
+		case []interface{}:
+			n = len(tv)
+		case string:
+			n = utf8.RuneCountInString(tv)
+		default:
+			return nil, fmt.Errorf("cannot slice %s", typeName(v))
+		}
+
+		i, err := bound(from, v, n, 0)
+		if err != nil {
+			return nil, err
+		}
+		j, err := bound(to, v, n, n)
+		if err != nil {
+			return nil, err
+		}
+		if j < i {
+			j = i
+		}
+
+		if s, ok := v.(string); ok {
+			return []interface{}{string([]rune(s)[i:j])}, nil
+		}
+		return []interface{}{append([]interface{}{}, v.([]interface{})[i:j]...)}, nil
+	}
+}
+
+func iterateFilter(v interface{}) ([]interface{}, error) {
+	switch tv := v.(type) {
+	case []interface{}:
+		return tv, nil
+	case jsonObject:
+		vs := make([]interface{}, len(tv))
+		for i, f := range tv {
+			vs[i] = f.Value
+		}
+		return vs, nil
+	}
+	return nil, fmt.Errorf("cannot iterate over %s", typeName(v))
+}
+
+func lengthFilter(v interface{}) ([]interface{}, error) {
+	var n int
+	switch tv := v.(type) {
+	case nil:
+	case string:
+		n = utf8.RuneCountInString(tv)
+	case []interface{}:
+		n = len(tv)
+	case jsonObject:
+		n = len(tv)
+	default:
+		return nil, fmt.Errorf("%s has no length", typeName(v))
+	}
+	return []interface{}{json.Number(strconv.Itoa(n))}, nil
+}
+
+func keysFilter(v interface{}) ([]interface{}, error) {
+	switch tv := v.(type) {
+	case jsonObject:
+		keys := make([]string, len(tv))
+		for i, f := range tv {
+			keys[i] = f.Key
+		}
+		sort.Strings(keys)
+		ks := make([]interface{}, len(keys))
+		for i, k := range keys {
+			ks[i] = k
+		}
+		return []interface{}{ks}, nil
+	case []interface{}:
+		ks := make([]interface{}, len(tv))
+		for i := range tv {
+			ks[i] = json.Number(strconv.Itoa(i))
+		}
+		return []interface{}{ks}, nil
+	}
+	return nil, fmt.Errorf("%s has no keys", typeName(v))
+}
+
+// truthy reports whether v counts as true: anything but false and null does.
+func truthy(v interface{}) bool {
+	b, isBool := v.(bool)
+	return v != nil && (!isBool || b)
+}
+
+// typeName returns the name of the JSON type of v.
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// typeOrder orders the JSON types of values as jq does.
+var typeOrder = map[string]int{"null": 0, "boolean": 1, "number": 2, "string": 3, "array": 4, "object": 5}
+
+// compareValues returns a negative number, zero or a positive number as a is
+// less than, equal to or greater than b.
+func compareValues(a, b interface{}) int {
+	ta, tb := typeName(a), typeName(b)
+	if ta != tb {
+		return typeOrder[ta] - typeOrder[tb]
+	}
+
+	switch ta {
+	case "null":
+		return 0
+	case "boolean":
+		ab, bb := a.(bool), b.(bool)
+		switch {
+		case ab == bb:
+			return 0
+		case bb:
+			return -1
+		}
+		return 1
+	case "number":
+		af, _ := a.(json.Number).Float64()
+		bf, _ := b.(json.Number).Float64()
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	case "string":
+		return strings.Compare(a.(string), b.(string))
+	}
+
+	as, _ := compactJSON(a)
+	bs, _ := compactJSON(b)
+	return strings.Compare(as, bs)
+}
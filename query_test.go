@@ -0,0 +1,110 @@
+package main_test
+
+import (
+	"encoding/json"
+
+	cli "github.com/elasticlic/els-cli"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Query Test Suite", func() {
+
+	doc := `{
+		"vendor": {"id": "v1", "name": "Vendor \"One\""},
+		"rulesets": [
+			{"id": "rs1", "price": 5, "active": true, "tags": ["a", "b"]},
+			{"id": "rs2", "price": 12, "active": false},
+			{"id": "rs3", "price": 8, "active": true}
+		],
+		"my key": "spaced"
+	}`
+
+	// check adds a test that query, applied to doc, gives the results exp,
+	// written as a compact JSON array.
+	check := func(query string, exp string) {
+		It("Evaluates "+query, func() {
+			q, err := cli.ParseQuery(query)
+			Expect(err).To(BeNil())
+			results, err := q.Run([]byte(doc))
+			Expect(err).To(BeNil())
+			out, err := json.Marshal(append([]interface{}{}, results...))
+			Expect(err).To(BeNil())
+			Expect(string(out)).To(Equal(exp))
+		})
+	}
+
+	Describe("Paths", func() {
+		check(".", `[{"vendor":{"id":"v1","name":"Vendor \"One\""},"rulesets":[{"id":"rs1","price":5,"active":true,"tags":["a","b"]},{"id":"rs2","price":12,"active":false},{"id":"rs3","price":8,"active":true}],"my key":"spaced"}]`)
+		check(".vendor.id", `["v1"]`)
+		check(".vendor | .name", `["Vendor \"One\""]`)
+		check(`."my key"`, `["spaced"]`)
+		check(`.["my key"]`, `["spaced"]`)
+		check(".missing", `[null]`)
+		check(".missing.deeper", `[null]`)
+		check(".rulesets[0].id", `["rs1"]`)
+		check(".rulesets[-1].id", `["rs3"]`)
+		check(".rulesets[9]", `[null]`)
+		check(".rulesets[1:].id?", `[]`)
+		check(".rulesets[:1][].tags", `[["a","b"]]`)
+		check("[.rulesets[1:][].id]", `[["rs2","rs3"]]`)
+		check(".rulesets[0].tags[:1]", `[["a"]]`)
+		check(".vendor.id[1:]", `["1"]`)
+	})
+
+	Describe("Multiple results", func() {
+		check(".rulesets[].id", `["rs1","rs2","rs3"]`)
+		check(".vendor[]", `["v1","Vendor \"One\""]`)
+		check(".vendor.id, .rulesets[0].id", `["v1","rs1"]`)
+		check(".rulesets[] | select(.price > 100)", `[]`)
+	})
+
+	Describe("Construction", func() {
+		check("[.rulesets[] | .price]", `[[5,12,8]]`)
+		check(".rulesets[] | {id, cost: .price}", `[{"id":"rs1","cost":5},{"id":"rs2","cost":12},{"id":"rs3","cost":8}]`)
+		check(`{"v": .vendor.id}`, `[{"v":"v1"}]`)
+		check("[]", `[[]]`)
+	})
+
+	Describe("Selection", func() {
+		check(".rulesets[] | select(.active) | .id", `["rs1","rs3"]`)
+		check(".rulesets[] | select(.price >= 8 and .active) | .id", `["rs3"]`)
+		check(".rulesets[] | select(.id == \"rs2\" or .price < 6) | .id", `["rs1","rs2"]`)
+		check(".rulesets[] | select(.active | not) | .id", `["rs2"]`)
+		check(".rulesets[] | select(.tags != null) | .id", `["rs1"]`)
+	})
+
+	Describe("Functions", func() {
+		check(".rulesets | length", `[3]`)
+		check(".vendor | keys", `[["id","name"]]`)
+		check(".vendor.name | length", `[12]`)
+		check("[.rulesets[] | .price > 6]", `[[false,true,true]]`)
+	})
+
+	Describe("Errors", func() {
+		It("Rejects invalid queries", func() {
+			for _, query := range []string{"", "rulesets", ".a[", ".a |", "select(.a", "{.a}", ".a ^ .b", `."unterminated`, "frobnicate"} {
+				_, err := cli.ParseQuery(query)
+				Expect(err).NotTo(BeNil(), query)
+				Expect(err.Error()).To(HavePrefix(cli.ErrInvalidQuery.Error()), query)
+			}
+		})
+
+		It("Reports queries which don't fit the document", func() {
+			q, err := cli.ParseQuery(".vendor.id.name")
+			Expect(err).To(BeNil())
+			_, err = q.Run([]byte(doc))
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring(cli.ErrQueryFailed.Error()))
+			Expect(err.Error()).To(ContainSubstring(`cannot get property "name" of string`))
+		})
+
+		It("Ignores errors with ?", func() {
+			q, err := cli.ParseQuery(".rulesets[] | .tags[]?")
+			Expect(err).To(BeNil())
+			results, err := q.Run([]byte(doc))
+			Expect(err).To(BeNil())
+			Expect(results).To(Equal([]interface{}{"a", "b"}))
+		})
+	})
+})
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	"github.com/elasticlic/go-utils/datetime"
+	log "github.com/sirupsen/logrus"
+)
+
+// RateLimiter is a token bucket which limits the rate at which API calls are
+// made. The bucket holds up to burst tokens, and is refilled at rate tokens per
+// second. Each call takes a token, waiting for one if the bucket is empty.
+type RateLimiter struct {
+	tp     datetime.TimeProvider
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter which allows perSec calls a second, in
+// bursts of up to burst calls, timed by tp. A burst of zero allows perSec calls
+// at once. It returns nil if perSec is zero, as calls are then not limited.
+func NewRateLimiter(perSec int, burst int, tp datetime.TimeProvider) *RateLimiter {
+	if perSec <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = perSec
+	}
+
+	return &RateLimiter{
+		tp:     tp,
+		rate:   float64(perSec),
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Reserve takes a token, and returns how long to wait before making the call
+// for which it was taken.
+func (l *RateLimiter) Reserve() time.Duration {
+	now := l.tp.Now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttle waits until the profile's rate limit allows another API call to be
+// made.
+func (e *ELSCLI) throttle() error {
+	if e.limiter == nil {
+		return nil
+	}
+
+	d := e.limiter.Reserve()
+	if d <= 0 {
+		return nil
+	}
+
+	log.WithFields(log.Fields{"Time": e.tp.Now(), "delay": d}).Debug("Rate limiting API call")
+
+	return e.wait(d)
+}
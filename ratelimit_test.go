@@ -0,0 +1,77 @@
+package main_test
+
+import (
+	"time"
+
+	cli "github.com/elasticlic/els-cli"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// clock is a datetime.TimeProvider whose time only changes when it is told to.
+type clock struct {
+	now time.Time
+}
+
+// Now implements interface datetime.TimeProvider.
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+var _ = Describe("Rate Limiter Test Suite", func() {
+
+	var (
+		c     *clock
+		l     *cli.RateLimiter
+		burst int
+
+		// reserve takes n tokens at once, and returns how long the call for
+		// each would wait.
+		reserve = func(n int) (waits []time.Duration) {
+			for i := 0; i < n; i++ {
+				waits = append(waits, l.Reserve())
+			}
+			return waits
+		}
+	)
+
+	BeforeEach(func() {
+		c = &clock{now: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)}
+		burst = 1
+	})
+
+	JustBeforeEach(func() {
+		l = cli.NewRateLimiter(5, burst, c)
+	})
+
+	It("Spaces out calls made at once", func() {
+		Expect(reserve(3)).To(Equal([]time.Duration{0, time.Millisecond * 200, time.Millisecond * 400}))
+	})
+
+	It("Refills the bucket as time passes", func() {
+		reserve(3)
+		c.now = c.now.Add(time.Millisecond * 400)
+		Expect(reserve(1)).To(Equal([]time.Duration{time.Millisecond * 200}))
+	})
+
+	It("Doesn't save up more than the burst", func() {
+		reserve(1)
+		c.now = c.now.Add(time.Hour)
+		Expect(reserve(2)).To(Equal([]time.Duration{0, time.Millisecond * 200}))
+	})
+
+	Context("The burst allows several calls", func() {
+		BeforeEach(func() {
+			burst = 3
+		})
+		It("Makes them at once", func() {
+			Expect(reserve(4)).To(Equal([]time.Duration{0, 0, 0, time.Millisecond * 200}))
+		})
+	})
+
+	Context("No rate is given", func() {
+		It("Doesn't limit calls", func() {
+			Expect(cli.NewRateLimiter(0, 0, c)).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryable reports whether an API call which returned rep and err should be
+// tried again.
+func (e *ELSCLI) retryable(rep *http.Response, err error) bool {
+	switch err {
+	case nil:
+	case ErrAPIUnreachable, ErrAPITimeout:
+		return true
+	default:
+		return false
+	}
+
+	switch rep.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return e.profile.RetryServerErrors
+	}
+
+	return false
+}
+
+// retryDelay returns how long to wait before retrying an API call which has
+// failed t times. The delay starts at APIRetryInterval and doubles with each
+// try, up to MaxAPIRetryInterval, and is reduced by a random amount of up to a
+// half so that clients don't retry in step. A longer delay requested by the ELS
+// with a Retry-After header in rep is respected.
+func (e *ELSCLI) retryDelay(t int, rep *http.Response) time.Duration {
+	d := MaxAPIRetryInterval
+	if t <= 6 {
+		if b := APIRetryInterval << uint(t-1); b < d {
+			d = b
+		}
+	}
+
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+
+	if ra := retryAfter(rep, e.tp.Now()); ra > d {
+		d = ra
+	}
+
+	return d
+}
+
+// retryAfter returns the delay requested by the Retry-After header of rep, or
+// zero if there is none. The header can give either a number of seconds or a
+// time, which is compared with now.
+func retryAfter(rep *http.Response, now time.Time) time.Duration {
+	if rep == nil {
+		return 0
+	}
+
+	h := rep.Header.Get("Retry-After")
+	if h == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(h); err == nil && secs > 0 {
+		return time.Second * time.Duration(secs)
+	}
+
+	if t, err := http.ParseTime(h); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return 0
+}
+
+// wait pauses for the duration d, unless the els-cli is interrupted first.
+func (e *ELSCLI) wait(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-e.ctx.Done():
+		return ErrInterrupted
+	}
+}
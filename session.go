@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/elasticlic/els-api-sdk-go/els"
+	"github.com/spf13/afero"
+)
+
+// Errors relating to recording and replaying API sessions.
+var (
+	ErrNotRecorded     = errors.New("No recorded response matches the API call")
+	ErrRecordAndReplay = errors.New("--record and --replay can't be used together")
+	ErrInvalidCassette = errors.New("The file given by --replay is not a recording made with --record")
+)
+
+// cassette holds the API calls recorded by --record, and replayed by --replay.
+type cassette struct {
+	Interactions []interaction `json:"interactions"`
+}
+
+// interaction is a single recorded API call and its response.
+type interaction struct {
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+// encodingBase64 is the BodyEncoding of a recorded body which isn't valid
+// UTF-8 - e.g. a PDF - and so is recorded base64 encoded, as a JSON string can
+// only hold text.
+const encodingBase64 = "base64"
+
+// recordedRequest is a request as it is recorded. Secrets are redacted from
+// the headers and body.
+type recordedRequest struct {
+	Method       string      `json:"method"`
+	Path         string      `json:"path"`
+	Query        string      `json:"query,omitempty"`
+	Headers      http.Header `json:"headers,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+}
+
+// recordedResponse is a response as it is recorded. Secrets are redacted from
+// the body.
+type recordedResponse struct {
+	StatusCode   int         `json:"statusCode"`
+	Headers      http.Header `json:"headers,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+}
+
+// matches reports whether the recorded request r matches the request rr, which
+// is yet to be made.
+func (r *recordedRequest) matches(rr *recordedRequest) bool {
+	return r.Method == rr.Method && r.Path == rr.Path && r.Query == rr.Query && r.Body == rr.Body && r.BodyEncoding == rr.BodyEncoding
+}
+
+// recordBody returns data as it is recorded, and the BodyEncoding with which
+// it is recorded. Secrets are only redacted from text.
+func recordBody(data []byte) (body string, encoding string) {
+	if !utf8.Valid(data) {
+		return base64.StdEncoding.EncodeToString(data), encodingBase64
+	}
+	return redactJSON(string(data)), ""
+}
+
+// body returns the recorded body of the response, decoded.
+func (r *recordedResponse) body() ([]byte, error) {
+	if r.BodyEncoding != encodingBase64 {
+		return []byte(r.Body), nil
+	}
+	data, err := base64.StdEncoding.DecodeString(r.Body)
+	if err != nil {
+		return nil, ErrInvalidCassette
+	}
+	return data, nil
+}
+
+// recordRequest returns req, whose URL is still relative to the API root, as it
+// is recorded - but without its headers, as it hasn't yet been signed.
+func recordRequest(req *http.Request) (*recordedRequest, error) {
+	r := &recordedRequest{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  req.URL.RawQuery,
+	}
+
+	if req.GetBody != nil {
+		b, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(b)
+		b.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.Body, r.BodyEncoding = recordBody(data)
+	}
+
+	return r, nil
+}
+
+// redactHeaders returns a copy of h with the values of headers which carry
+// secrets redacted.
+func redactHeaders(h http.Header) http.Header {
+	rh := make(http.Header, len(h))
+	for n, vs := range h {
+		for _, v := range vs {
+			if secretHeader.MatchString(n) {
+				v = redactHeader(v)
+			}
+			rh[n] = append(rh[n], v)
+		}
+	}
+	return rh
+}
+
+// recorder is an els.APICaller which records each call made with Do, and its
+// response, to a cassette file. Calls to CreateAccessKey are not recorded, as
+// they carry a password and return a secret.
+type recorder struct {
+	els.APICaller
+	fs   afero.Fs
+	file string
+	c    cassette
+}
+
+// newRecorder returns a recorder which makes calls with ac and records them to
+// file, replacing anything already in it.
+func newRecorder(ac els.APICaller, fs afero.Fs, file string) (*recorder, error) {
+	r := &recorder{APICaller: ac, fs: fs, file: file}
+	return r, r.save()
+}
+
+// Do implements els.APICaller.
+func (r *recorder) Do(ctx context.Context, req *http.Request, s els.Signer, prefixRoot bool) (*http.Response, error) {
+	rr, err := recordRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rep, err := r.APICaller.Do(ctx, req, s, prefixRoot)
+	if err != nil {
+		return rep, err
+	}
+	rr.Headers = redactHeaders(req.Header)
+
+	var data []byte
+	if rep.Body != nil {
+		data, err = ioutil.ReadAll(rep.Body)
+		rep.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		rep.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+
+	recorded := recordedResponse{
+		StatusCode: rep.StatusCode,
+		Headers:    redactHeaders(rep.Header),
+	}
+	recorded.Body, recorded.BodyEncoding = recordBody(data)
+
+	r.c.Interactions = append(r.c.Interactions, interaction{
+		Request:  *rr,
+		Response: recorded,
+	})
+
+	return rep, r.save()
+}
+
+// save writes the calls recorded so far to the cassette file, so they are kept
+// even if the els-cli fails part way through.
+func (r *recorder) save() error {
+	data, err := json.MarshalIndent(&r.c, "", "\t")
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(r.fs, r.file, append(data, '\n'), 0600)
+}
+
+// replayer is an els.APICaller which responds to each call with a response
+// read from a cassette file, rather than calling the ELS.
+type replayer struct {
+	c    cassette
+	used []bool
+}
+
+// newReplayer returns a replayer which replays the calls recorded in file.
+func newReplayer(fs afero.Fs, file string) (*replayer, error) {
+	data, err := afero.ReadFile(fs, file)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &replayer{}
+	if err := json.Unmarshal(data, &r.c); err != nil {
+		return nil, ErrInvalidCassette
+	}
+	r.used = make([]bool, len(r.c.Interactions))
+
+	return r, nil
+}
+
+// Do implements els.APICaller. Each recorded call is replayed once, in the
+// order recorded. Once they have all been replayed, a call is answered with the
+// last response recorded for it.
+func (r *replayer) Do(ctx context.Context, req *http.Request, s els.Signer, prefixRoot bool) (*http.Response, error) {
+	rr, err := recordRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	found := -1
+	for i := range r.c.Interactions {
+		if !r.c.Interactions[i].Request.matches(rr) {
+			continue
+		}
+		found = i
+		if !r.used[i] {
+			break
+		}
+	}
+
+	if found < 0 {
+		return nil, ErrNotRecorded
+	}
+	r.used[found] = true
+
+	rep := r.c.Interactions[found].Response
+	body, err := rep.body()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rep.StatusCode, http.StatusText(rep.StatusCode)),
+		StatusCode:    rep.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rep.Headers,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// CreateAccessKey implements els.APICaller. Access Keys are never recorded, so
+// can't be replayed.
+func (r *replayer) CreateAccessKey(ctx context.Context, email string, password string, isAdmin bool, expiryDays uint) (*els.AccessKey, int, error) {
+	return nil, 0, ErrNotRecorded
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Errors relating to --template and --template-file.
+var (
+	ErrInvalidTemplate = errors.New("Invalid template")
+	ErrTemplateAndFile = errors.New("--template and --template-file can't be used together")
+	ErrInvalidDate     = errors.New("Not a date - expected an RFC3339 date or a Unix time")
+	ErrInvalidAmount   = errors.New("Not an amount of money")
+)
+
+// currencies gives the symbol, and the number of minor units, of the
+// currencies known to the currency template function. Others are written with
+// their code, and two minor units.
+var currencies = map[string]struct {
+	symbol string
+	minor  int
+}{
+	"GBP": {"£", 2},
+	"USD": {"$", 2},
+	"EUR": {"€", 2},
+	"JPY": {"¥", 0},
+}
+
+// templateFuncs are the functions which can be called by templates, in
+// addition to the text/template builtins.
+var templateFuncs = template.FuncMap{
+	// json returns its argument as compact JSON.
+	"json": func(v interface{}) (string, error) {
+		return compactJSON(v)
+	},
+
+	// jsonIndent returns its argument as JSON indented with tabs.
+	"jsonIndent": func(v interface{}) (string, error) {
+		data, err := json.MarshalIndent(v, "", "\t")
+		return string(data), err
+	},
+
+	// date formats a date, given in RFC3339 or as a Unix time, with a Go time
+	// layout - e.g. {{date "2006-01-02" .expiryDate}}.
+	"date": formatDate,
+
+	// currency formats an amount of the currency with the given ISO 4217 code -
+	// e.g. {{currency "GBP" .price}} gives "£1,234.50".
+	"currency": formatCurrency,
+
+	// join joins the elements of an array with a separator - e.g.
+	// {{join ", " .tags}}.
+	"join": func(sep string, a []interface{}) string {
+		s := make([]string, len(a))
+		for i, e := range a {
+			s[i] = fmt.Sprint(e)
+		}
+		return strings.Join(s, sep)
+	},
+
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// ParseTemplate parses text as a text/template which renders response bodies.
+func ParseTemplate(text string) (*template.Template, error) {
+	t, err := template.New("template").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrInvalidTemplate, err)
+	}
+	return t, nil
+}
+
+// initTemplate sets the template given by --template, or read from the file
+// given by --template-file, if either is given.
+func (e *ELSCLI) initTemplate(text string, file string) error {
+	e.template = nil
+
+	if file != "" {
+		if text != "" {
+			return ErrTemplateAndFile
+		}
+		data, err := afero.ReadFile(e.fs, file)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	} else if text == "" {
+		return nil
+	}
+
+	t, err := ParseTemplate(text)
+	if err != nil {
+		return err
+	}
+	e.template = t
+	return nil
+}
+
+// writeTemplate renders the JSON data to w with the template t. Objects are
+// decoded as maps, so their properties can be referred to by name - e.g.
+// {{.id}} - and numbers are written exactly as they were received.
+func writeTemplate(w io.Writer, data []byte, t *template.Template) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+
+	// The template is rendered in full before anything is written, so nothing
+	// is written if it fails:
+	var b bytes.Buffer
+	if err := t.Execute(&b, v); err != nil {
+		return err
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// formatDate formats the date v, an RFC3339 string or a Unix time, with the
+// time layout.
+func formatDate(layout string, v interface{}) (string, error) {
+	var t time.Time
+
+	switch tv := v.(type) {
+	case time.Time:
+		t = tv
+	case string:
+		var err error
+		if t, err = time.Parse(time.RFC3339, tv); err != nil {
+			return "", ErrInvalidDate
+		}
+	default:
+		secs, err := number(v)
+		if err != nil {
+			return "", ErrInvalidDate
+		}
+		t = time.Unix(int64(secs), 0).UTC()
+	}
+
+	return t.Format(layout), nil
+}
+
+// formatCurrency formats the amount v of the currency with the given code,
+// with its symbol (or code) and a comma between each group of three digits.
+func formatCurrency(code string, v interface{}) (string, error) {
+	amount, err := number(v)
+	if err != nil {
+		return "", ErrInvalidAmount
+	}
+
+	c, known := currencies[strings.ToUpper(code)]
+	if !known {
+		c.minor = 2
+	}
+
+	s := strconv.FormatFloat(math.Abs(amount), 'f', c.minor, 64)
+	units, minor := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		units, minor = s[:i], s[i:]
+	}
+	for i := len(units) - 3; i > 0; i -= 3 {
+		units = units[:i] + "," + units[i:]
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+	}
+
+	if !known {
+		return sign + units + minor + " " + code, nil
+	}
+	return sign + c.symbol + units + minor, nil
+}
+
+// number returns v, which may be a number or a string containing one, as a
+// float64.
+func number(v interface{}) (float64, error) {
+	switch tv := v.(type) {
+	case json.Number:
+		return tv.Float64()
+	case string:
+		return strconv.ParseFloat(tv, 64)
+	case float64:
+		return tv, nil
+	case int:
+		return float64(tv), nil
+	case int64:
+		return float64(tv), nil
+	}
+	return 0, fmt.Errorf("%v is not a number", v)
+}
@@ -0,0 +1,63 @@
+package main_test
+
+import (
+	"bytes"
+
+	cli "github.com/elasticlic/els-cli"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Template Test Suite", func() {
+
+	// check adds a test that text, rendered with no data, gives exp.
+	check := func(text string, exp string) {
+		It("Renders "+text, func() {
+			t, err := cli.ParseTemplate(text)
+			Expect(err).To(BeNil())
+			var b bytes.Buffer
+			Expect(t.Execute(&b, nil)).To(Succeed())
+			Expect(b.String()).To(Equal(exp))
+		})
+	}
+
+	Describe("Dates", func() {
+		check(`{{date "2006-01-02" "2018-07-14T10:20:30Z"}}`, "2018-07-14")
+		check(`{{date "02 Jan 2006 15:04 MST" "2018-07-14T10:20:30+01:00"}}`, "14 Jul 2018 10:20 +0100")
+		check(`{{date "2006-01-02T15:04:05Z07:00" 1531563630}}`, "2018-07-14T10:20:30Z")
+	})
+
+	Describe("Currency", func() {
+		check(`{{currency "GBP" 1234.5}}`, "£1,234.50")
+		check(`{{currency "usd" "-0.5"}}`, "-$0.50")
+		check(`{{currency "JPY" 1234567}}`, "¥1,234,567")
+		check(`{{currency "CHF" 999}}`, "999.00 CHF")
+	})
+
+	Describe("Other functions", func() {
+		check(`{{json "a<b"}}`, `"a<b"`)
+		check(`{{upper "id"}} {{lower "ID"}}`, "ID id")
+	})
+
+	Describe("Errors", func() {
+		It("Rejects invalid templates", func() {
+			_, err := cli.ParseTemplate("{{range .}}")
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(HavePrefix(cli.ErrInvalidTemplate.Error()))
+		})
+		It("Rejects values which aren't dates", func() {
+			t, err := cli.ParseTemplate(`{{date "2006" "yesterday"}}`)
+			Expect(err).To(BeNil())
+			err = t.Execute(&bytes.Buffer{}, nil)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring(cli.ErrInvalidDate.Error()))
+		})
+		It("Rejects values which aren't amounts", func() {
+			t, err := cli.ParseTemplate(`{{currency "GBP" "lots"}}`)
+			Expect(err).To(BeNil())
+			err = t.Execute(&bytes.Buffer{}, nil)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring(cli.ErrInvalidAmount.Error()))
+		})
+	})
+})
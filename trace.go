@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/elasticlic/els-api-sdk-go/els"
+)
+
+// redacted replaces secrets in the output of --verbose.
+const redacted = "[REDACTED]"
+
+// secretHeader matches the names of headers whose values must not be shown by
+// --verbose, as they carry the signature or other credentials.
+var secretHeader = regexp.MustCompile(`(?i)authorization|signature|secret|token|cookie`)
+
+// secretJSON matches JSON properties whose values must not be shown by
+// --verbose.
+var secretJSON = regexp.MustCompile(`(?i)("(?:password|secretAccessKey)"\s*:\s*)"[^"]*"`)
+
+// tracingSigner is an els.Signer which signs requests with Signer and then
+// traces them, just before they are sent.
+type tracingSigner struct {
+	els.Signer
+	e      *ELSCLI
+	traced bool
+}
+
+// Sign implements els.Signer.
+func (s *tracingSigner) Sign(r *http.Request, now time.Time) error {
+	if err := s.Signer.Sign(r, now); err != nil {
+		return err
+	}
+	s.e.traceRequest(r)
+	s.traced = true
+	return nil
+}
+
+// traceRequest writes the method, URL, headers and body of a request which is
+// being sent to the error stream. Secrets are redacted.
+func (e *ELSCLI) traceRequest(req *http.Request) {
+	w := e.errorStream
+
+	fmt.Fprintf(w, "> %s %s\n", req.Method, req.URL)
+	e.traceHeaders(">", req.Header)
+
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := ioutil.ReadAll(body)
+			body.Close()
+			e.traceBody(">", req.Header.Get("Content-Type"), data)
+		}
+	}
+}
+
+// traceResponse writes the status, headers and body of a response, and how
+// long it took, to the error stream. The body is read and replaced, so it can
+// still be read by the caller.
+func (e *ELSCLI) traceResponse(rep *http.Response, elapsed time.Duration) error {
+	w := e.errorStream
+
+	fmt.Fprintf(w, "< %s (%s)\n", rep.Status, elapsed.Round(time.Millisecond))
+	e.traceHeaders("<", rep.Header)
+
+	if rep.Body == nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(rep.Body)
+	rep.Body.Close()
+	if err != nil {
+		return err
+	}
+	rep.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	e.traceBody("<", rep.Header.Get("Content-Type"), data)
+	return nil
+}
+
+// traceError writes an error which prevented a request from completing to the
+// error stream.
+func (e *ELSCLI) traceError(err error, elapsed time.Duration) {
+	fmt.Fprintf(e.errorStream, "* %s (%s)\n", err, elapsed.Round(time.Millisecond))
+}
+
+// traceHeaders writes headers h, sorted by name, with each line prefixed by
+// prefix. The values of headers which carry secrets are redacted, other than
+// the authorization scheme.
+func (e *ELSCLI) traceHeaders(prefix string, h http.Header) {
+	for _, n := range sortedHeaderNames(h) {
+		for _, v := range h[n] {
+			if secretHeader.MatchString(n) {
+				v = redactHeader(v)
+			}
+			fmt.Fprintf(e.errorStream, "%s %s: %s\n", prefix, n, v)
+		}
+	}
+	fmt.Fprintln(e.errorStream, prefix)
+}
+
+// redactHeader returns the header value v with everything but its first word
+// (e.g. the authorization scheme) redacted.
+func redactHeader(v string) string {
+	if i := strings.IndexByte(v, ' '); i > 0 {
+		return v[:i+1] + redacted
+	}
+	return redacted
+}
+
+// traceBody writes a request or response body whose Content-Type is
+// contentType, with each line prefixed by prefix, and any passwords and
+// secretAccessKeys redacted. A binary body (see bodyKind) is only summarised,
+// so that it never reaches a terminal.
+func (e *ELSCLI) traceBody(prefix string, contentType string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	if bodyKind(contentType, data) == bodyBinary {
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		fmt.Fprintf(e.errorStream, "%s <%d bytes %s>\n", prefix, len(data), contentType)
+		return
+	}
+
+	body := redactJSON(string(data))
+	for _, l := range strings.Split(strings.TrimRight(body, "\n"), "\n") {
+		fmt.Fprintf(e.errorStream, "%s %s\n", prefix, l)
+	}
+}
+
+// redactJSON returns the JSON s with the values of any passwords and
+// secretAccessKeys redacted.
+func redactJSON(s string) string {
+	return secretJSON.ReplaceAllString(s, `$1"`+redacted+`"`)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Errors relating to the network settings of a profile.
+var (
+	ErrInvalidProxyURL   = errors.New("Invalid proxy URL - it must be an absolute http, https or socks5 URL")
+	ErrInvalidTLSVersion = errors.New("Invalid TLS version - must be: 1.0|1.1|1.2|1.3")
+	ErrInvalidCABundle   = errors.New("The CA bundle contains no PEM encoded certificates")
+	ErrIncompleteCert    = errors.New("clientCert and clientKey must be given together")
+)
+
+// tlsVersions maps the values of minTLSVersion to the TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ValidProxyURL returns ErrInvalidProxyURL unless u is empty or an absolute
+// http, https or socks5 URL.
+func ValidProxyURL(u string) error {
+	if u == "" {
+		return nil
+	}
+
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https" && pu.Scheme != "socks5") || pu.Host == "" {
+		return ErrInvalidProxyURL
+	}
+	return nil
+}
+
+// ValidTLSVersion reports whether v is empty or one of the TLS versions which
+// can be given as the minTLSVersion.
+func ValidTLSVersion(v string) bool {
+	_, ok := tlsVersions[v]
+	return ok || v == ""
+}
+
+// Transport returns the http.Transport through which the profile's API calls
+// are made, configured with its proxy and TLS settings. Any CA bundle and
+// client certificate are read from fs. Without a httpProxy, the proxy is taken
+// from the HTTPS_PROXY and HTTP_PROXY environment variables, as usual.
+func (p *Profile) Transport(fs afero.Fs) (*http.Transport, error) {
+	pc := httpproxy.FromEnvironment()
+	if p.HTTPProxy != "" {
+		pc.HTTPProxy, pc.HTTPSProxy = p.HTTPProxy, p.HTTPProxy
+	}
+	if p.NoProxy != "" {
+		pc.NoProxy = p.NoProxy
+	}
+	proxy := pc.ProxyFunc()
+
+	tc, err := p.tlsConfig(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	// As http.DefaultTransport, other than the proxy and TLS settings:
+	return &http.Transport{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			return proxy(r.URL)
+		},
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tc,
+	}, nil
+}
+
+// tlsConfig returns the TLS settings defined by the profile, or nil if it
+// uses the defaults.
+func (p *Profile) tlsConfig(fs afero.Fs) (*tls.Config, error) {
+	if p.CABundle == "" && p.ClientCert == "" && p.ClientKey == "" && p.MinTLSVersion == "" {
+		return nil, nil
+	}
+
+	tc := &tls.Config{}
+
+	if p.MinTLSVersion != "" {
+		v, ok := tlsVersions[p.MinTLSVersion]
+		if !ok {
+			return nil, ErrInvalidTLSVersion
+		}
+		tc.MinVersion = v
+	}
+
+	if p.CABundle != "" {
+		pem, err := afero.ReadFile(fs, p.CABundle)
+		if err != nil {
+			return nil, err
+		}
+
+		// The bundle's CAs are trusted as well as the system's:
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCABundle
+		}
+		tc.RootCAs = pool
+	}
+
+	if (p.ClientCert == "") != (p.ClientKey == "") {
+		return nil, ErrIncompleteCert
+	}
+
+	if p.ClientCert != "" {
+		certPEM, err := afero.ReadFile(fs, p.ClientCert)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := afero.ReadFile(fs, p.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
@@ -0,0 +1,150 @@
+package main_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	cli "github.com/elasticlic/els-cli"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/afero"
+)
+
+var _ = Describe("Transport Test Suite", func() {
+
+	var (
+		fs  afero.Fs
+		p   *cli.Profile
+		sut *http.Transport
+		err error
+
+		// selfSigned returns a new self-signed certificate and its key, PEM
+		// encoded.
+		selfSigned = func() (certPEM []byte, keyPEM []byte) {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).To(BeNil())
+			tmpl := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+			Expect(err).To(BeNil())
+			kder, err := x509.MarshalECPrivateKey(key)
+			Expect(err).To(BeNil())
+			return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+				pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+		}
+	)
+
+	BeforeEach(func() {
+		fs = afero.NewMemMapFs()
+		p = cli.NewProfile()
+	})
+
+	JustBeforeEach(func() {
+		sut, err = p.Transport(fs)
+	})
+
+	Describe("Proxy", func() {
+		BeforeEach(func() {
+			Expect(p.Set(cli.KeyHTTPProxy, "http://proxy.example.com:3128")).To(Succeed())
+			Expect(p.Set(cli.KeyNoProxy, "internal.example.com")).To(Succeed())
+		})
+		It("Calls the API through the proxy", func() {
+			req, _ := http.NewRequest("GET", "https://api.example.com/1.0/vendors", nil)
+			u, err := sut.Proxy(req)
+			Expect(err).To(BeNil())
+			Expect(u.String()).To(Equal("http://proxy.example.com:3128"))
+		})
+		It("Calls the hosts in noProxy directly", func() {
+			req, _ := http.NewRequest("GET", "https://internal.example.com/1.0/vendors", nil)
+			u, err := sut.Proxy(req)
+			Expect(err).To(BeNil())
+			Expect(u).To(BeNil())
+		})
+		It("Rejects an invalid proxy URL", func() {
+			Expect(p.Set(cli.KeyHTTPProxy, "proxy.example.com")).To(Equal(cli.ErrInvalidProxyURL))
+		})
+	})
+
+	Describe("TLS version", func() {
+		BeforeEach(func() {
+			Expect(p.Set(cli.KeyMinTLSVersion, "1.2")).To(Succeed())
+		})
+		It("Sets the minimum TLS version", func() {
+			Expect(sut.TLSClientConfig.MinVersion).To(BeEquivalentTo(tls.VersionTLS12))
+		})
+		It("Rejects an unknown version", func() {
+			Expect(p.Set(cli.KeyMinTLSVersion, "2.0")).To(Equal(cli.ErrInvalidTLSVersion))
+		})
+	})
+
+	Describe("CA bundle", func() {
+		var server *httptest.Server
+		BeforeEach(func() {
+			server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+			afero.WriteFile(fs, "ca.pem", ca, 0644)
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+		Context("The server's CA is in the bundle", func() {
+			BeforeEach(func() {
+				p.CABundle = "ca.pem"
+			})
+			It("Trusts the server", func() {
+				Expect(err).To(BeNil())
+				_, err := (&http.Client{Transport: sut}).Get(server.URL)
+				Expect(err).To(BeNil())
+			})
+		})
+		Context("No bundle is given", func() {
+			It("Doesn't trust the server", func() {
+				_, err := (&http.Client{Transport: sut}).Get(server.URL)
+				Expect(err).NotTo(BeNil())
+			})
+		})
+		Context("The bundle contains no certificates", func() {
+			BeforeEach(func() {
+				afero.WriteFile(fs, "empty.pem", []byte("none"), 0644)
+				p.CABundle = "empty.pem"
+			})
+			It("Returns an error", func() {
+				Expect(err).To(Equal(cli.ErrInvalidCABundle))
+			})
+		})
+	})
+
+	Describe("Client certificate", func() {
+		BeforeEach(func() {
+			cert, key := selfSigned()
+			afero.WriteFile(fs, "client.pem", cert, 0644)
+			afero.WriteFile(fs, "client.key", key, 0600)
+			p.ClientCert = "client.pem"
+		})
+		Context("The key is given", func() {
+			BeforeEach(func() {
+				p.ClientKey = "client.key"
+			})
+			It("Presents the certificate", func() {
+				Expect(err).To(BeNil())
+				Expect(sut.TLSClientConfig.Certificates).To(HaveLen(1))
+			})
+		})
+		Context("The key is missing", func() {
+			It("Returns an error", func() {
+				Expect(err).To(Equal(cli.ErrIncompleteCert))
+			})
+		})
+	})
+})
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Problems which can be found in the config file by Validate.
+var (
+	ErrMissingValue   = errors.New("No value is given for a required key")
+	ErrKeyExpired     = errors.New("The Access Key has expired")
+	ErrKeyExpiresSoon = errors.New("The Access Key will expire soon")
+	ErrInvalidConfig  = errors.New("The config file has errors")
+)
+
+// ExpiryWarningPeriod determines how long before an Access Key expires Validate
+// starts to warn about it.
+const ExpiryWarningPeriod = time.Hour * 24 * 7
+
+// Problem describes something wrong with the config file.
+type Problem struct {
+	// Key identifies where in the config file the problem was found - e.g.
+	// "profiles.ci.maxAPITries".
+	Key string
+
+	// Err describes the problem.
+	Err error
+
+	// Warning is set if the problem won't prevent the profile being used.
+	Warning bool
+}
+
+// String returns a description of the problem, suitable for output.
+func (p Problem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+
+	return fmt.Sprintf("%s: %s: %s", level, p.Key, p.Err)
+}
+
+// Validate checks the config and returns any problems found, ordered by
+// profile. Profiles are checked with the settings they inherit, and the
+// expiry of Access Keys is judged against now.
+//
+// The settings of each profile are decoded afresh from the TOML document over
+// the defaults, rather than taken from Profiles, so that a setting given as
+// zero is reported rather than hidden by its default, and a profile which
+// can't be resolved is reported rather than checked with default settings.
+func (c *Config) Validate(now time.Time) (problems []Problem) {
+	for _, k := range c.undecoded {
+		problems = append(problems, Problem{Key: k, Err: ErrUnknownKey})
+	}
+
+	tables := c.profileTables()
+	for _, id := range c.ProfileIDs() {
+		p := c.Profiles[id]
+		if _, ok := tables[id]; ok {
+			p = NewProfile()
+			if err := c.decodeProfile(id, p); err != nil {
+				problems = append(problems, Problem{Key: "profiles." + id, Err: err})
+				continue
+			}
+		}
+		problems = append(problems, p.validate("profiles."+id+".", now)...)
+	}
+
+	return problems
+}
+
+// validate returns any problems with the profile's settings. Keys are prefixed
+// with prefix to show where the profile is in the config file.
+func (p *Profile) validate(prefix string, now time.Time) (problems []Problem) {
+	add := func(key string, err error, warning bool) {
+		problems = append(problems, Problem{Key: prefix + key, Err: err, Warning: warning})
+	}
+
+	if !ValidOutput(p.Output) {
+		add(KeyOutput, ErrInvalidOutput, false)
+	}
+
+	if p.MaxAPITries <= 0 {
+		add(KeyMaxAPITries, ErrInvalidValue, false)
+	}
+
+	if p.APITimeoutSecs <= 0 {
+		add(KeyAPITimeoutSecs, ErrInvalidValue, false)
+	}
+
+	if p.MaxRequestsPerSecond < 0 {
+		add(KeyMaxRequestsPerSec, ErrInvalidValue, false)
+	}
+
+	if p.Burst < 0 {
+		add(KeyBurst, ErrInvalidValue, false)
+	}
+
+	if p.APIURL != "" {
+		if err := ValidAPIURL(p.APIURL); err != nil {
+			add(KeyAPIURL, err, false)
+		}
+	}
+
+	if err := ValidProxyURL(p.HTTPProxy); err != nil {
+		add(KeyHTTPProxy, err, false)
+	}
+
+	if !ValidTLSVersion(p.MinTLSVersion) {
+		add(KeyMinTLSVersion, ErrInvalidTLSVersion, false)
+	}
+
+	if (p.ClientCert == "") != (p.ClientKey == "") {
+		add(KeyClientCert, ErrIncompleteCert, false)
+	}
+
+	// A credentialProcess can supply the whole Access Key, and the other
+	// sources the secret:
+	k := p.AccessKey
+	if p.CredentialProcess == "" {
+		if k.ID == "" {
+			add(KeyAccessKey+"."+KeyID, ErrMissingValue, false)
+		}
+		if k.SecretAccessKey == "" && p.SecretAccessKeyFile == "" && p.SecretAccessKeyEnv == "" {
+			add(KeyAccessKey+"."+KeySecretAccessKey, ErrMissingValue, false)
+		}
+	}
+
+	// The email is only needed to manage the Access Key:
+	if k.Email == "" {
+		add(KeyAccessKey+"."+KeyEmail, ErrMissingValue, true)
+	}
+
+	if !k.ExpiryDate.IsZero() {
+		if !k.ExpiryDate.After(now) {
+			add(KeyAccessKey+"."+KeyExpiryDate, ErrKeyExpired, false)
+		} else if k.ExpiryDate.Before(now.Add(ExpiryWarningPeriod)) {
+			add(KeyAccessKey+"."+KeyExpiryDate, ErrKeyExpiresSoon, true)
+		}
+	}
+
+	return problems
+}
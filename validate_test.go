@@ -0,0 +1,209 @@
+package main_test
+
+import (
+	"strings"
+	"time"
+
+	cli "github.com/elasticlic/els-cli"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Validate Test Suite", func() {
+
+	var (
+		toml     string
+		now      time.Time
+		problems []cli.Problem
+
+		// readErr is the error expected from reading the config, if any.
+		readErr error
+
+		// keyProblem returns the problem found with the given key, if any.
+		keyProblem = func(key string) *cli.Problem {
+			for i := range problems {
+				if problems[i].Key == key {
+					return &problems[i]
+				}
+			}
+			return nil
+		}
+	)
+
+	BeforeEach(func() {
+		readErr = nil
+		now = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		toml = `
+			[profiles.default]
+				[profiles.default.accessKey]
+					id = "elsID1"
+					secretAccessKey = "secretAccessKey1"
+					email = "email1@example.com"
+					expiryDate = "2020-02-01T12:00:00Z"
+		`
+	})
+
+	JustBeforeEach(func() {
+		c, err := cli.ReadTOML(strings.NewReader(toml))
+		if readErr == nil {
+			Expect(err).To(BeNil())
+		} else {
+			Expect(err.Error()).To(HavePrefix(readErr.Error()))
+		}
+		problems = c.Validate(now)
+	})
+
+	Context("The config is valid", func() {
+		It("finds no problems", func() {
+			Expect(problems).To(BeEmpty())
+		})
+	})
+
+	Context("A key is misspelt", func() {
+		BeforeEach(func() {
+			toml += `
+			[profiles.ci]
+				extends = "default"
+				maxAPITrys = 3
+			`
+		})
+		It("reports the unknown key", func() {
+			Expect(problems).To(Equal([]cli.Problem{
+				{Key: "profiles.ci.maxAPITrys", Err: cli.ErrUnknownKey},
+			}))
+		})
+	})
+
+	Context("Values are invalid", func() {
+		BeforeEach(func() {
+			toml += `
+			[profiles.ci]
+				extends = "default"
+				output = "everything"
+				maxAPITries = -1
+				apiTimeoutSecs = -5
+				apiURL = "staging"
+			`
+		})
+		It("reports each invalid value", func() {
+			Expect(keyProblem("profiles.ci.output").Err).To(Equal(cli.ErrInvalidOutput))
+			Expect(keyProblem("profiles.ci.maxAPITries").Err).To(Equal(cli.ErrInvalidValue))
+			Expect(keyProblem("profiles.ci.apiTimeoutSecs").Err).To(Equal(cli.ErrInvalidValue))
+			Expect(keyProblem("profiles.ci.apiURL").Err).To(Equal(cli.ErrInvalidAPIURL))
+			Expect(problems).To(HaveLen(4))
+		})
+	})
+
+	Context("Values which have defaults are given as zero", func() {
+		BeforeEach(func() {
+			toml += `
+			[profiles.ci]
+				extends = "default"
+				maxAPITries = 0
+				apiTimeoutSecs = 0
+			`
+		})
+		It("reports them rather than using the defaults", func() {
+			Expect(keyProblem("profiles.ci.maxAPITries").Err).To(Equal(cli.ErrInvalidValue))
+			Expect(keyProblem("profiles.ci.apiTimeoutSecs").Err).To(Equal(cli.ErrInvalidValue))
+			Expect(problems).To(HaveLen(2))
+		})
+	})
+
+	Context("Profiles extend each other in a cycle", func() {
+		BeforeEach(func() {
+			readErr = cli.ErrExtendsCycle
+			toml += `
+			[profiles.a]
+				extends = "b"
+			[profiles.b]
+				extends = "a"
+			`
+		})
+		It("reports each profile in the cycle, and checks the others", func() {
+			Expect(problems).To(HaveLen(2))
+			Expect(problems[0].Key).To(Equal("profiles.a"))
+			Expect(problems[0].Err.Error()).To(HavePrefix(cli.ErrExtendsCycle.Error()))
+			Expect(problems[1].Key).To(Equal("profiles.b"))
+		})
+	})
+
+	Context("A profile extends a missing profile", func() {
+		BeforeEach(func() {
+			readErr = cli.ErrParentNotFound
+			toml += `
+			[profiles.ci]
+				extends = "missing"
+			`
+		})
+		It("reports the profile", func() {
+			Expect(problems).To(HaveLen(1))
+			Expect(problems[0].Key).To(Equal("profiles.ci"))
+			Expect(problems[0].Err.Error()).To(HavePrefix(cli.ErrParentNotFound.Error()))
+		})
+	})
+
+	Context("A value has the wrong type", func() {
+		BeforeEach(func() {
+			readErr = cli.ErrInvalidValue
+			toml += `
+			[profiles.ci]
+				extends = "default"
+				maxAPITries = "3"
+			`
+		})
+		It("reports the profile", func() {
+			Expect(problems).To(HaveLen(1))
+			Expect(problems[0].Key).To(Equal("profiles.ci"))
+			Expect(problems[0].Err.Error()).To(HavePrefix(cli.ErrInvalidValue.Error()))
+		})
+	})
+
+	Context("Access Key settings are missing", func() {
+		BeforeEach(func() {
+			toml += `
+			[profiles.ci]
+				output = "bodyOnly"
+			`
+		})
+		It("reports an error for the missing id and secret", func() {
+			Expect(*keyProblem("profiles.ci.accessKey.id")).To(Equal(cli.Problem{Key: "profiles.ci.accessKey.id", Err: cli.ErrMissingValue}))
+			Expect(keyProblem("profiles.ci.accessKey.secretAccessKey").Warning).To(BeFalse())
+		})
+		It("reports a warning for the missing email", func() {
+			Expect(keyProblem("profiles.ci.accessKey.email").Warning).To(BeTrue())
+		})
+		Context("The secret is obtained from another source", func() {
+			BeforeEach(func() {
+				toml += `
+				secretAccessKeyEnv = "ELS_SECRET"
+				`
+			})
+			It("doesn't report the missing secret", func() {
+				Expect(keyProblem("profiles.ci.accessKey.secretAccessKey")).To(BeNil())
+			})
+		})
+	})
+
+	Context("The Access Key expires soon", func() {
+		BeforeEach(func() {
+			now = time.Date(2020, 1, 30, 12, 0, 0, 0, time.UTC)
+		})
+		It("reports a warning", func() {
+			Expect(problems).To(Equal([]cli.Problem{
+				{Key: "profiles.default.accessKey.expiryDate", Err: cli.ErrKeyExpiresSoon, Warning: true},
+			}))
+		})
+	})
+
+	Context("The Access Key has expired", func() {
+		BeforeEach(func() {
+			now = time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+		})
+		It("reports an error", func() {
+			Expect(problems).To(Equal([]cli.Problem{
+				{Key: "profiles.default.accessKey.expiryDate", Err: cli.ErrKeyExpired},
+			}))
+		})
+	})
+})